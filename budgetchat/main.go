@@ -2,14 +2,21 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"regexp"
 	"strings"
 	"sync"
 	"unicode/utf8"
+
+	"github.com/mehix/protohackers/logging"
+	"github.com/mehix/protohackers/lrcp"
+	"github.com/mehix/protohackers/metrics"
+	"github.com/mehix/protohackers/server"
 )
 
 var reUsername = regexp.MustCompile(`^([0-9a-zA-Z]*[a-zA-Z]+[0-9a-zA-Z]*)$`)
@@ -34,6 +41,18 @@ func (u User) SendMessage(msg string) error {
 type BudgetChat struct {
 	Users map[string]User
 	m     sync.RWMutex
+
+	messages *metrics.Counter // chat lines relayed
+}
+
+// instrument exposes the room in r.
+func (b *BudgetChat) instrument(r *metrics.Registry) {
+	b.messages = r.Counter("budgetchat_messages_total", "Chat messages relayed.")
+	r.GaugeFunc("budgetchat_users", "Users in the room.", func() int64 {
+		b.m.RLock()
+		defer b.m.RUnlock()
+		return int64(len(b.Users))
+	})
 }
 
 func (b *BudgetChat) Usernames() []string {
@@ -87,50 +106,68 @@ func (b *BudgetChat) SendAllExcept(msg string, user User) {
 	}
 }
 
+var (
+	overLRCP     = flag.Bool("lrcp", false, "serve over LRCP on UDP instead of TCP")
+	serverConfig = server.Flags(flag.CommandLine)
+	logConfig    = logging.Flags(flag.CommandLine)
+)
+
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: budgetchat <addr>")
+	flag.Parse()
+	logConfig.Install()
+	if flag.NArg() < 1 {
+		fmt.Println("Usage: budgetchat [flags] <addr>")
 		os.Exit(1)
 	}
 
-	bg := &BudgetChat{
-		Users: make(map[string]User, 0),
-	}
+	ctx, stop := server.SignalContext()
+	defer stop()
 
-	if err := bg.Start(os.Args[1]); err != nil {
-		log.Fatal(err)
+	reg, err := serverConfig.Metrics(ctx)
+	if err != nil {
+		slog.Error("starting metrics endpoint", "err", err)
+		os.Exit(1)
 	}
-}
 
-func (b *BudgetChat) Start(addr string) error {
-	l, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
+	bg := &BudgetChat{
+		Users: make(map[string]User, 0),
 	}
-	defer l.Close()
+	bg.instrument(reg)
 
-	fmt.Printf("Listening on %s\n", addr)
+	srv := serverConfig.Server(flag.Arg(0), bg, reg)
 
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			return err
-		}
+	if *overLRCP {
+		srv.Listen = (&lrcp.ListenConfig{Metrics: reg}).Listen
+	}
 
-		go b.manageUserSession(conn)
+	if err := srv.ListenAndServe(ctx); err != nil && err != server.ErrServerClosed {
+		slog.Error("server stopped", "err", err)
+		os.Exit(1)
 	}
 }
 
-func (b *BudgetChat) manageUserSession(conn net.Conn) {
+// ServeConn runs one user's chat session.
+func (b *BudgetChat) ServeConn(ctx context.Context, conn net.Conn) {
+	b.manageUserSession(ctx, conn)
+}
+
+const shutdownNotice = "* server shutting down"
+
+func (b *BudgetChat) manageUserSession(ctx context.Context, conn net.Conn) {
 
 	defer conn.Close()
 
 	done := make(chan bool)
 	defer close(done)
 
+	log := logging.FromContext(ctx)
+
 	username, err := b.askUsername(conn)
 	if err != nil {
-		log.Println(err)
+		log.Info("rejected user", "err", err)
+		if ctx.Err() != nil {
+			fmt.Fprintln(conn, shutdownNotice)
+		}
 		return
 	}
 
@@ -141,7 +178,8 @@ func (b *BudgetChat) manageUserSession(conn net.Conn) {
 
 	b.AddUser(user)
 
-	fmt.Printf("new user: %s\n", username)
+	log = log.With("user", username)
+	log.Info("user joined")
 
 	// wait for messages from user
 	scnr := bufio.NewScanner(conn)
@@ -150,15 +188,18 @@ func (b *BudgetChat) manageUserSession(conn net.Conn) {
 		if txt == "" {
 			continue
 		}
-		fmt.Printf("%s wrote: %s\n", username, txt)
+		log.Debug("message", "text", txt)
+		b.messages.Inc()
 		b.SendAllExcept(fmt.Sprintf("[%s] %s", username, txt), user)
 	}
 
-	fmt.Printf("%s left the room\n", username)
+	if ctx.Err() != nil {
+		user.SendMessage(shutdownNotice)
+	}
 
 	b.DeleteUser(user)
 
-	fmt.Println("byyyyye")
+	log.Info("user left")
 }
 
 func (b *BudgetChat) askUsername(conn net.Conn) (string, error) {
@@ -1,6 +1,14 @@
 package main
 
-import "testing"
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/mehix/protohackers/server"
+)
 
 func TestValidateUsername(t *testing.T) {
 
@@ -33,3 +41,43 @@ func TestValidateUsername(t *testing.T) {
 		})
 	}
 }
+
+func TestShutdownNotice(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bg := &BudgetChat{Users: make(map[string]User)}
+	srv := &server.Server{Handler: bg}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- srv.Serve(ctx, l)
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	rdr := bufio.NewReader(c)
+	rdr.ReadString('\n') // welcome
+	fmt.Fprintln(c, "alice")
+	rdr.ReadString('\n') // room contents
+
+	cancel()
+
+	line, err := rdr.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != shutdownNotice+"\n" {
+		t.Fatalf("wrong notice. expected: %q, got: %q", shutdownNotice, line)
+	}
+
+	<-done
+}
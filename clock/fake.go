@@ -0,0 +1,151 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Fake is a clock that only moves when Advance is called. Timers and
+// tickers fire during Advance, in the order they are due; AfterFunc
+// functions run on the goroutine calling Advance.
+type Fake struct {
+	m       sync.Mutex
+	now     time.Time
+	waiters map[*waiter]struct{}
+	armed   *sync.Cond // signalled whenever a timer or ticker is started
+}
+
+// NewFake returns a fake clock showing now.
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now, waiters: make(map[*waiter]struct{})}
+	f.armed = sync.NewCond(&f.m)
+	return f
+}
+
+// waiter is a fake timer, ticker or AfterFunc.
+type waiter struct {
+	f      *Fake
+	at     time.Time
+	period time.Duration // of a ticker, 0 for timers
+	c      chan time.Time
+	fn     func()
+}
+
+func (f *Fake) Now() time.Time {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	return f.now
+}
+
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	return fakeTicker{f.start(&waiter{f: f, period: d, c: make(chan time.Time, 1)}, d)}
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	return fakeTimer{f.start(&waiter{f: f, c: make(chan time.Time, 1)}, d)}
+}
+
+func (f *Fake) AfterFunc(d time.Duration, fn func()) Timer {
+	return fakeTimer{f.start(&waiter{f: f, fn: fn}, d)}
+}
+
+func (f *Fake) start(w *waiter, d time.Duration) *waiter {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	w.at = f.now.Add(d)
+	f.waiters[w] = struct{}{}
+	f.armed.Broadcast()
+	return w
+}
+
+// stop reports whether w was active.
+func (f *Fake) stop(w *waiter) bool {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	_, ok := f.waiters[w]
+	delete(f.waiters, w)
+	return ok
+}
+
+// Advance moves the clock forward by d and fires every timer and ticker
+// due by then.
+func (f *Fake) Advance(d time.Duration) {
+	f.m.Lock()
+	target := f.now.Add(d)
+
+	for {
+		var next *waiter
+		for w := range f.waiters {
+			if !w.at.After(target) && (next == nil || w.at.Before(next.at)) {
+				next = w
+			}
+		}
+		if next == nil {
+			break
+		}
+
+		f.now = next.at
+		if next.period > 0 {
+			next.at = next.at.Add(next.period)
+		} else {
+			delete(f.waiters, next)
+		}
+
+		if next.fn != nil {
+			f.m.Unlock()
+			next.fn()
+			f.m.Lock()
+			continue
+		}
+
+		// like the time package, drop the tick if the last one was not read
+		select {
+		case next.c <- f.now:
+		default:
+		}
+	}
+
+	f.now = target
+	f.m.Unlock()
+}
+
+// Waiters returns the number of active timers and tickers.
+func (f *Fake) Waiters() int {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	return len(f.waiters)
+}
+
+// BlockUntil waits until at least n timers and tickers are active, so a
+// test can advance the clock once the code under test started waiting.
+func (f *Fake) BlockUntil(n int) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	for len(f.waiters) < n {
+		f.armed.Wait()
+	}
+}
+
+type fakeTicker struct{ w *waiter }
+
+func (t fakeTicker) C() <-chan time.Time { return t.w.c }
+func (t fakeTicker) Stop()               { t.w.f.stop(t.w) }
+
+type fakeTimer struct{ w *waiter }
+
+func (t fakeTimer) C() <-chan time.Time { return t.w.c }
+func (t fakeTimer) Stop() bool          { return t.w.f.stop(t.w) }
+
+func (t fakeTimer) Reset(d time.Duration) bool {
+	active := t.w.f.stop(t.w)
+	t.w.f.start(t.w, d)
+	return active
+}
@@ -0,0 +1,126 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestFakeTimer(t *testing.T) {
+
+	f := NewFake(epoch)
+	tmr := f.NewTimer(time.Second)
+
+	f.Advance(999 * time.Millisecond)
+	select {
+	case <-tmr.C():
+		t.Fatal("timer fired early")
+	default:
+	}
+
+	f.Advance(time.Millisecond)
+	select {
+	case at := <-tmr.C():
+		if !at.Equal(epoch.Add(time.Second)) {
+			t.Fatalf("wrong fire time: %v", at)
+		}
+	default:
+		t.Fatal("timer did not fire")
+	}
+
+	if f.Waiters() != 0 {
+		t.Fatal("fired timer still active")
+	}
+}
+
+func TestFakeTimerStopAndReset(t *testing.T) {
+
+	f := NewFake(epoch)
+	tmr := f.NewTimer(time.Second)
+
+	if !tmr.Stop() {
+		t.Fatal("stopping an active timer should report true")
+	}
+	f.Advance(time.Hour)
+	select {
+	case <-tmr.C():
+		t.Fatal("stopped timer fired")
+	default:
+	}
+
+	tmr.Reset(time.Minute)
+	f.Advance(time.Minute)
+	select {
+	case <-tmr.C():
+	default:
+		t.Fatal("reset timer did not fire")
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+
+	f := NewFake(epoch)
+	tkr := f.NewTicker(2 * time.Second)
+	defer tkr.Stop()
+
+	ticks := 0
+	for i := 0; i < 5; i++ {
+		f.Advance(2 * time.Second)
+		select {
+		case <-tkr.C():
+			ticks++
+		default:
+		}
+	}
+	if ticks != 5 {
+		t.Fatalf("expected 5 ticks, got %d", ticks)
+	}
+
+	// unread ticks are dropped, like with the time package
+	f.Advance(10 * time.Second)
+	<-tkr.C()
+	select {
+	case <-tkr.C():
+		t.Fatal("more than one tick buffered")
+	default:
+	}
+}
+
+func TestFakeAfterFuncOrder(t *testing.T) {
+
+	f := NewFake(epoch)
+	var order []int
+	f.AfterFunc(3*time.Second, func() { order = append(order, 3) })
+	f.AfterFunc(time.Second, func() { order = append(order, 1) })
+	f.AfterFunc(2*time.Second, func() {
+		order = append(order, 2)
+		if now := f.Now(); !now.Equal(epoch.Add(2 * time.Second)) {
+			t.Errorf("wrong time while firing: %v", now)
+		}
+	})
+
+	f.Advance(time.Minute)
+
+	if len(order) != 3 || order[0] != 1 || order[1] != 2 || order[2] != 3 {
+		t.Fatalf("wrong order: %v", order)
+	}
+	if now := f.Now(); !now.Equal(epoch.Add(time.Minute)) {
+		t.Fatalf("wrong time after advance: %v", now)
+	}
+}
+
+func TestFakeBlockUntil(t *testing.T) {
+
+	f := NewFake(epoch)
+	done := make(chan struct{})
+	go func() {
+		tmr := f.NewTimer(time.Second)
+		<-tmr.C()
+		close(done)
+	}()
+
+	f.BlockUntil(1)
+	f.Advance(time.Second)
+	<-done
+}
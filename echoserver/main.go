@@ -1,55 +1,57 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"os"
+
+	"github.com/mehix/protohackers/logging"
+	"github.com/mehix/protohackers/lrcp"
+	"github.com/mehix/protohackers/server"
+)
+
+var (
+	overLRCP     = flag.Bool("lrcp", false, "serve over LRCP on UDP instead of TCP")
+	serverConfig = server.Flags(flag.CommandLine)
+	logConfig    = logging.Flags(flag.CommandLine)
 )
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: echosrvr <addr>")
+	flag.Parse()
+	logConfig.Install()
+	if flag.NArg() < 1 {
+		fmt.Println("Usage: echosrvr [flags] <addr>")
 		os.Exit(1)
 	}
 
-	addr := os.Args[1]
+	ctx, stop := server.SignalContext()
+	defer stop()
 
-	if err := startSrvr(addr); err != nil {
-		log.Println(err)
-	}
-}
-
-func startSrvr(addr string) error {
-	l, err := net.Listen("tcp", addr)
+	reg, err := serverConfig.Metrics(ctx)
 	if err != nil {
-		return err
+		slog.Error("starting metrics endpoint", "err", err)
+		os.Exit(1)
 	}
-	defer l.Close()
 
-	fmt.Printf("Listen on %s\n", addr)
+	srv := serverConfig.Server(flag.Arg(0), server.HandlerFunc(handleConn), reg)
 
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			return err
-		}
+	if *overLRCP {
+		srv.Listen = (&lrcp.ListenConfig{Metrics: reg}).Listen
+	}
 
-		go handleConn(conn)
+	if err := srv.ListenAndServe(ctx); err != nil && err != server.ErrServerClosed {
+		slog.Error("server stopped", "err", err)
+		os.Exit(1)
 	}
 }
 
-func handleConn(conn net.Conn) {
+func handleConn(_ context.Context, conn net.Conn) {
 
-	defer func() func() {
-		fmt.Printf("Connection from %s\n", conn.RemoteAddr())
-		msg := fmt.Sprintf("Done with %s!", conn.RemoteAddr())
-		return func() {
-			fmt.Println(msg)
-			conn.Close()
-		}
-	}()()
+	defer conn.Close()
 
 	io.Copy(conn, conn)
 }
@@ -1,5 +1,5 @@
 module github.com/mehix/protohackers
 
-go 1.20
+go 1.21
 
 require golang.org/x/exp v0.0.0-20230425010034-47ecfdc1ba53
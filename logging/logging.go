@@ -0,0 +1,62 @@
+// Package logging sets up the structured logger of the protohackers binaries
+// and carries per-connection loggers in contexts.
+package logging
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// Config is the logger chosen on the command line.
+type Config struct {
+	Level  slog.Level
+	Format string // "text" or "json"
+}
+
+// Flags registers -log-level and -log-format on fs.
+func Flags(fs *flag.FlagSet) *Config {
+	c := &Config{Format: "text"}
+	fs.TextVar(&c.Level, "log-level", slog.LevelInfo, "minimum level logged: debug, info, warn or error")
+	fs.Func("log-format", "log format: text or json (default text)", func(s string) error {
+		if s != "text" && s != "json" {
+			return fmt.Errorf("unknown log format %q", s)
+		}
+		c.Format = s
+		return nil
+	})
+	return c
+}
+
+// New returns a logger writing to w.
+func (c *Config) New(w io.Writer) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: c.Level}
+	if c.Format == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// Install makes a logger writing to stderr the default one, for slog and for
+// the log package.
+func (c *Config) Install() {
+	slog.SetDefault(c.New(os.Stderr))
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying l.
+func NewContext(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx, or the default logger.
+func FromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
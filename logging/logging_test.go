@@ -0,0 +1,75 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestFlags(t *testing.T) {
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c := Flags(fs)
+	if err := fs.Parse([]string{"-log-level", "warn", "-log-format", "json"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	l := c.New(&buf)
+	l.Info("hidden")
+	l.Warn("shown", "session", 7)
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected one JSON entry, got %q: %v", buf.String(), err)
+	}
+	if entry["msg"] != "shown" || entry["session"] != float64(7) {
+		t.Fatalf("wrong entry: %v", entry)
+	}
+}
+
+func TestFlagsDefaults(t *testing.T) {
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c := Flags(fs)
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	l := c.New(&buf)
+	l.Debug("hidden")
+	l.Info("shown")
+
+	if out := buf.String(); !strings.Contains(out, "msg=shown") || strings.Contains(out, "hidden") {
+		t.Fatalf("wrong output: %q", out)
+	}
+}
+
+func TestFlagsRejectUnknownValues(t *testing.T) {
+
+	for _, args := range [][]string{{"-log-level", "loud"}, {"-log-format", "xml"}} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(new(bytes.Buffer))
+		Flags(fs)
+		if err := fs.Parse(args); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+
+	if FromContext(context.Background()) != slog.Default() {
+		t.Fatal("expected the default logger without one in the context")
+	}
+
+	l := slog.New(slog.NewTextHandler(new(bytes.Buffer), nil))
+	if FromContext(NewContext(context.Background(), l)) != l {
+		t.Fatal("expected the logger from the context")
+	}
+}
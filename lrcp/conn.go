@@ -0,0 +1,427 @@
+package lrcp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mehix/protohackers/clock"
+)
+
+// ErrClosedByPeer is returned by Write once the peer closed the session.
+var ErrClosedByPeer = errors.New("lrcp: session closed by peer")
+
+// ErrSessionExpired is returned by Read and Write once the session was closed
+// because the peer went silent.
+var ErrSessionExpired = errors.New("lrcp: session expired")
+
+// Conn is one LRCP session. Reads block until data arrives; writes never
+// block, the data is sent right away and kept until the peer acknowledges
+// it. A packet not acknowledged within the retransmission timeout of its
+// last sending is sent again. The session expires once the peer has sent
+// nothing for the session timeout.
+type Conn struct {
+	ep      *endpoint
+	id      int
+	remote  net.Addr
+	log     *slog.Logger
+	stop    chan struct{} // closed when the session ends
+	release func(*Conn)   // called once the session ended
+
+	m            sync.Mutex
+	readable     *sync.Cond // signalled when in grows, the session ends or the read deadline changes
+	acknowledged *sync.Cond // signalled when the peer acknowledges data or the session ends
+	in           []byte     // received, not read yet
+	received     int        // length of the data received
+	out          []byte     // written, not acknowledged yet; starts at acked
+	acked        int        // length of the data the peer acknowledged
+	chunks       []chunk    // packets of out, by position
+	retransmit   clock.Timer
+	armed        bool      // retransmit is running
+	ended        bool      // closed by either side
+	closed       bool      // Close was called
+	expired      bool      // ended by the session timeout
+	heard        time.Time // last packet from the peer
+	idle         clock.Timer
+	readDeadline time.Time
+	readTimer    *time.Timer
+}
+
+// chunk is the data of one /data/ packet, out[pos-acked:end-acked].
+type chunk struct {
+	pos, end int
+	sent     time.Time
+}
+
+func newConn(ep *endpoint, id int, remote net.Addr, release func(*Conn)) *Conn {
+	c := &Conn{
+		ep:      ep,
+		id:      id,
+		remote:  remote,
+		log:     ep.log.With("session", id, "remote", remote.String()),
+		stop:    make(chan struct{}),
+		release: release,
+	}
+	c.readable = sync.NewCond(&c.m)
+	c.acknowledged = sync.NewCond(&c.m)
+	return c
+}
+
+// start arms the session timeout. It is called once the session is
+// registered, so a Conn dropped before that leaves no timer behind.
+func (c *Conn) start() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.ended {
+		return
+	}
+	c.heard = c.ep.clock.Now()
+	c.idle = c.ep.clock.AfterFunc(c.ep.expiry, c.expire)
+}
+
+// ID returns the session ID chosen by the peer.
+func (c *Conn) ID() int { return c.id }
+
+// Read reads the data received. It returns io.EOF once the peer closed the
+// session and everything it sent was read.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for len(c.in) == 0 {
+		switch {
+		case c.closed:
+			return 0, net.ErrClosed
+		case c.expired:
+			return 0, ErrSessionExpired
+		case c.ended:
+			return 0, io.EOF
+		case !c.readDeadline.IsZero() && !time.Now().Before(c.readDeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.readable.Wait()
+	}
+
+	n := copy(b, c.in)
+	c.in = c.in[n:]
+	return n, nil
+}
+
+// Write sends b to the peer.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.m.Lock()
+	switch {
+	case c.closed:
+		c.m.Unlock()
+		return 0, net.ErrClosed
+	case c.expired:
+		c.m.Unlock()
+		return 0, ErrSessionExpired
+	case c.ended:
+		c.m.Unlock()
+		return 0, ErrClosedByPeer
+	}
+	pos := c.acked + len(c.out)
+	c.out = append(c.out, b...)
+	now := c.ep.clock.Now()
+	var packets [][]byte
+	for _, ch := range split(c.id, pos, b) {
+		ch.sent = now
+		c.chunks = append(c.chunks, ch)
+		packets = append(packets, c.packet(ch))
+	}
+	c.arm(c.ep.rto)
+	c.m.Unlock()
+
+	for _, p := range packets {
+		c.ep.send(c.remote, p)
+	}
+	return len(b), nil
+}
+
+// Flush waits until the peer acknowledged everything written, the session
+// ended or ctx is done. LRCP has no half close, so a peer done writing
+// flushes before it closes, or the data still unacknowledged is lost.
+func (c *Conn) Flush(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() {
+		c.m.Lock()
+		defer c.m.Unlock()
+		c.acknowledged.Broadcast()
+	})
+	defer stop()
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for len(c.out) > 0 {
+		switch {
+		case c.closed:
+			return net.ErrClosed
+		case c.expired:
+			return ErrSessionExpired
+		case c.ended:
+			return ErrClosedByPeer
+		case ctx.Err() != nil:
+			return ctx.Err()
+		}
+		c.acknowledged.Wait()
+	}
+	return nil
+}
+
+// Close ends the session and tells the peer.
+func (c *Conn) Close() error {
+	c.m.Lock()
+	if c.closed {
+		c.m.Unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	ended := c.ended
+	c.m.Unlock()
+
+	if !ended {
+		c.ep.send(c.remote, closeMsg(c.id))
+	}
+	c.end()
+	return nil
+}
+
+// end stops the session. It is called once either side closed it.
+func (c *Conn) end() {
+	c.m.Lock()
+	if c.ended {
+		c.m.Unlock()
+		return
+	}
+	c.ended = true
+	close(c.stop)
+	if c.readTimer != nil {
+		c.readTimer.Stop()
+	}
+	if c.retransmit != nil {
+		c.retransmit.Stop()
+	}
+	if c.idle != nil {
+		c.idle.Stop()
+	}
+	c.readable.Broadcast()
+	c.acknowledged.Broadcast()
+	c.m.Unlock()
+
+	c.release(c)
+	c.log.Debug("session ended")
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.ep.pc.LocalAddr() }
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline makes blocked and future reads fail once t passed. Like
+// for any net.Conn, t is a time of the real clock.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.readDeadline = t
+	if c.readTimer != nil {
+		c.readTimer.Stop()
+		c.readTimer = nil
+	}
+	if !t.IsZero() && !c.ended {
+		c.readTimer = time.AfterFunc(time.Until(t), func() {
+			c.m.Lock()
+			defer c.m.Unlock()
+			c.readable.Broadcast()
+		})
+	}
+	c.readable.Broadcast()
+	return nil
+}
+
+// SetWriteDeadline does nothing, writes never block.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// handle processes a packet the peer sent to the session.
+func (c *Conn) handle(m message) {
+	c.m.Lock()
+	c.heard = c.ep.clock.Now()
+	c.m.Unlock()
+
+	switch m.kind {
+	case kindConnect:
+		c.ep.send(c.remote, ackMsg(c.id, c.receivedLen()))
+	case kindData:
+		c.ep.send(c.remote, ackMsg(c.id, c.receive(m.pos, m.data)))
+	case kindAck:
+		if !c.ack(m.pos) {
+			c.log.Debug("ack beyond the data sent, closing", "length", m.pos)
+			c.Close()
+		}
+	case kindClose:
+		c.ep.send(c.remote, closeMsg(c.id))
+		c.end()
+	}
+}
+
+// expire closes the session if the peer has been silent for the session
+// timeout, or waits for the rest of it.
+func (c *Conn) expire() {
+	c.m.Lock()
+	if c.ended {
+		c.m.Unlock()
+		return
+	}
+	if silent := c.ep.clock.Now().Sub(c.heard); silent < c.ep.expiry {
+		c.idle.Reset(c.ep.expiry - silent)
+		c.m.Unlock()
+		return
+	}
+	c.expired = true
+	c.m.Unlock()
+
+	c.log.Debug("session expired")
+	c.ep.stats.expired.Inc()
+	c.ep.send(c.remote, closeMsg(c.id))
+	c.end()
+}
+
+// receivedLen returns the length of the data received so far.
+func (c *Conn) receivedLen() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.received
+}
+
+// receive takes data sent at pos if it continues the data received so far,
+// and returns the length to acknowledge.
+func (c *Conn) receive(pos int, data []byte) int {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if pos == c.received && !c.ended && len(data) > 0 {
+		c.in = append(c.in, data...)
+		c.received += len(data)
+		c.readable.Broadcast()
+	}
+	return c.received
+}
+
+// ack handles an acknowledgement of length bytes. It returns false if the
+// peer acknowledged data that was never sent.
+func (c *Conn) ack(length int) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if length <= c.acked {
+		return true
+	}
+	if length > c.acked+len(c.out) {
+		return false
+	}
+	c.out = c.out[length-c.acked:]
+	c.acked = length
+
+	for len(c.chunks) > 0 && c.chunks[0].end <= length {
+		c.chunks = c.chunks[1:]
+	}
+	if len(c.chunks) > 0 && c.chunks[0].pos < length {
+		c.chunks[0].pos = length
+	}
+	if len(c.chunks) == 0 && c.armed {
+		c.retransmit.Stop()
+		c.armed = false
+	}
+	c.acknowledged.Broadcast()
+	return true
+}
+
+// arm starts the retransmission timer unless it is already due earlier. c.m
+// must be held.
+func (c *Conn) arm(d time.Duration) {
+	if c.armed {
+		return
+	}
+	if c.retransmit == nil {
+		c.retransmit = c.ep.clock.AfterFunc(d, c.retransmitDue)
+	} else {
+		c.retransmit.Reset(d)
+	}
+	c.armed = true
+}
+
+// retransmitDue sends again the packets whose retransmission timeout
+// expired, and arms the timer for the next one.
+func (c *Conn) retransmitDue() {
+	c.m.Lock()
+	c.armed = false
+	if c.ended {
+		c.m.Unlock()
+		return
+	}
+
+	now := c.ep.clock.Now()
+	var packets [][]byte
+	var next time.Time
+	for i := range c.chunks {
+		ch := &c.chunks[i]
+		if !now.Before(ch.sent.Add(c.ep.rto)) {
+			ch.sent = now
+			packets = append(packets, c.packet(*ch))
+		}
+		if due := ch.sent.Add(c.ep.rto); next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+	if !next.IsZero() {
+		c.arm(next.Sub(now))
+	}
+	c.m.Unlock()
+
+	c.ep.stats.retransmissions.Add(uint64(len(packets)))
+	for _, p := range packets {
+		c.ep.send(c.remote, p)
+	}
+}
+
+// packet returns the /data/ packet of ch. c.m must be held.
+func (c *Conn) packet(ch chunk) []byte {
+	return dataMsg(c.id, ch.pos, c.out[ch.pos-c.acked:ch.end-c.acked])
+}
+
+// split cuts data written at pos into chunks whose /data/ packets stay below
+// maxPacket bytes once escaped.
+func split(session, pos int, data []byte) []chunk {
+	var chunks []chunk
+	for len(data) > 0 {
+		room := maxPacket - 1 - len(dataMsg(session, pos, nil))
+		n := 0
+		for ; n < len(data); n++ {
+			size := 1
+			if data[n] == '/' || data[n] == '\\' {
+				size = 2
+			}
+			if size > room {
+				break
+			}
+			room -= size
+		}
+		chunks = append(chunks, chunk{pos: pos, end: pos + n})
+		pos += n
+		data = data[n:]
+	}
+	return chunks
+}
@@ -0,0 +1,139 @@
+package lrcp
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/mehix/protohackers/clock"
+)
+
+// ErrConnectTimeout is returned by Dial when the server does not acknowledge
+// the connect in time.
+var ErrConnectTimeout = errors.New("lrcp: connect not acknowledged")
+
+// dialTimeout bounds the connect when the Dialer sets no Timeout.
+const dialTimeout = 60 * time.Second
+
+// Dialer holds the options for opening sessions. The zero value is ready to
+// use.
+type Dialer struct {
+	// Timeout is how long the server gets to acknowledge the connect. Zero
+	// means one minute.
+	Timeout time.Duration
+
+	// RetransmitTimeout is how long a packet, connect included, waits for
+	// its ack before it is sent again. Zero means 3 seconds.
+	RetransmitTimeout time.Duration
+
+	// SessionTimeout is how long the session stays open without any packet
+	// from the server. Zero means 60 seconds.
+	SessionTimeout time.Duration
+
+	// Clock times the connect, the retransmissions and the session timeout.
+	// Nil means the real clock.
+	Clock clock.Clock
+
+	// Logger logs the session. Nil means slog.Default().
+	Logger *slog.Logger
+}
+
+// Dial opens a session to the LRCP server at the UDP address addr.
+func Dial(addr string) (net.Conn, error) {
+	var d Dialer
+	return d.DialContext(context.Background(), addr)
+}
+
+// Dial opens a session to the LRCP server at the UDP address addr.
+func (d *Dialer) Dial(addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), addr)
+}
+
+// DialContext opens a session to the LRCP server at the UDP address addr. It
+// sends /connect/ every retransmission timeout until the server acknowledges it,
+// ctx is done or the Timeout expires. Each session gets its own UDP socket,
+// closed with the session.
+func (d *Dialer) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+
+	ep := newEndpoint(pc, d.RetransmitTimeout, d.SessionTimeout, d.Clock, d.Logger, nil)
+	c := newConn(ep, rand.Intn(maxNumber), raddr, func(*Conn) { pc.Close() })
+	connected := make(chan struct{})
+	go c.serve(connected)
+
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = dialTimeout
+	}
+	if err := c.connect(ctx, connected, timeout); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.start()
+
+	c.log.Debug("session opened")
+	return c, nil
+}
+
+// serve handles the packets the server sends to a dialed session until it
+// ends. connected is closed on the first ack.
+func (c *Conn) serve(connected chan struct{}) {
+	acked := false
+	handle := func(m message, addr net.Addr) {
+		switch {
+		case addr.String() != c.remote.String():
+			c.ep.discard(addr, "not the server")
+		case m.session != c.id:
+			c.ep.discard(addr, "unknown session")
+		case m.kind == kindConnect:
+			c.ep.discard(addr, "connect sent to a client")
+		default:
+			if m.kind == kindAck && !acked {
+				acked = true
+				close(connected)
+			}
+			c.handle(m)
+		}
+	}
+	c.ep.serve(handle, func() bool {
+		select {
+		case <-c.stop:
+			return true
+		default:
+			return false
+		}
+	})
+}
+
+// connect sends /connect/ until connected is closed.
+func (c *Conn) connect(ctx context.Context, connected <-chan struct{}, timeout time.Duration) error {
+	tkr := c.ep.clock.NewTicker(c.ep.rto)
+	defer tkr.Stop()
+	tmr := c.ep.clock.NewTimer(timeout)
+	defer tmr.Stop()
+
+	for {
+		c.ep.send(c.remote, connectMsg(c.id))
+		select {
+		case <-connected:
+			return nil
+		case <-c.stop:
+			return ErrClosedByPeer
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tmr.C():
+			return ErrConnectTimeout
+		case <-tkr.C():
+		}
+	}
+}
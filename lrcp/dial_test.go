@@ -0,0 +1,229 @@
+package lrcp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mehix/protohackers/clock"
+)
+
+// rawServer is the server side of a test, speaking raw LRCP packets to the
+// one client that writes to it.
+type rawServer struct {
+	t      *testing.T
+	pc     net.PacketConn
+	client net.Addr
+}
+
+func newRawServer(t *testing.T) *rawServer {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return &rawServer{t: t, pc: pc}
+}
+
+func (s *rawServer) receive() string {
+	s.t.Helper()
+
+	buf := make([]byte, maxPacket)
+	s.pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, err := s.pc.ReadFrom(buf)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.client = addr
+	return string(buf[:n])
+}
+
+func (s *rawServer) send(format string, args ...any) {
+	s.t.Helper()
+	if _, err := s.pc.WriteTo([]byte(fmt.Sprintf(format, args...)), s.client); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+var connectPacket = regexp.MustCompile(`^/connect/([0-9]+)/$`)
+
+// acceptConnect receives a connect and returns its session ID.
+func (s *rawServer) acceptConnect() int {
+	s.t.Helper()
+
+	packet := s.receive()
+	parts := connectPacket.FindStringSubmatch(packet)
+	if parts == nil {
+		s.t.Fatalf("expected a connect, got: %q", packet)
+	}
+	id, _ := strconv.Atoi(parts[1])
+	return id
+}
+
+func TestDialEcho(t *testing.T) {
+
+	l := listen(t, ListenConfig{})
+	go echo(l)
+
+	c, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Fprintln(c, "hello/world\\")
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "hello/world\\\n" {
+		t.Fatalf("wrong echo. expected: %q, got: %q", "hello/world\\\n", line)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected net.ErrClosed, got: %v", err)
+	}
+}
+
+func TestDialRetransmits(t *testing.T) {
+
+	clk := clock.NewFake(time.Unix(0, 0))
+	s := newRawServer(t)
+	d := &Dialer{Clock: clk}
+
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	dialed := make(chan result, 1)
+	go func() {
+		c, err := d.Dial(s.pc.LocalAddr().String())
+		dialed <- result{c, err}
+	}()
+
+	// the first connect is lost
+	id := s.acceptConnect()
+	clk.BlockUntil(2)
+	clk.Advance(defaultRetransmitTimeout)
+	if again := s.acceptConnect(); again != id {
+		t.Fatalf("connect sent again for another session: %d, not %d", again, id)
+	}
+	s.send("/ack/%d/0/", id)
+
+	r := <-dialed
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	c := r.c
+	defer c.Close()
+
+	// data from the server is acknowledged and readable in order
+	s.send("/data/%d/3/def/", id)
+	if got, want := s.receive(), fmt.Sprintf("/ack/%d/0/", id); got != want {
+		t.Fatalf("wrong packet. expected: %q, got: %q", want, got)
+	}
+	s.send("/data/%d/0/abc/", id)
+	if got, want := s.receive(), fmt.Sprintf("/ack/%d/3/", id); got != want {
+		t.Fatalf("wrong packet. expected: %q, got: %q", want, got)
+	}
+	buf := make([]byte, 10)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "abc" {
+		t.Fatalf("wrong data. expected: %q, got: %q", "abc", buf[:n])
+	}
+
+	// data to the server is sent until acknowledged
+	c.Write([]byte("xyz"))
+	want := fmt.Sprintf("/data/%d/0/xyz/", id)
+	if got := s.receive(); got != want {
+		t.Fatalf("wrong packet. expected: %q, got: %q", want, got)
+	}
+	clk.Advance(defaultRetransmitTimeout)
+	if got := s.receive(); got != want {
+		t.Fatalf("wrong retransmission. expected: %q, got: %q", want, got)
+	}
+	s.send("/ack/%d/3/", id)
+
+	// closed by the server
+	s.send("/close/%d/", id)
+	if got, want := s.receive(), fmt.Sprintf("/close/%d/", id); got != want {
+		t.Fatalf("wrong packet. expected: %q, got: %q", want, got)
+	}
+	if _, err := io.ReadAll(c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+
+	s := newRawServer(t)
+	d := &Dialer{Timeout: 50 * time.Millisecond}
+
+	_, err := d.Dial(s.pc.LocalAddr().String())
+	if err != ErrConnectTimeout {
+		t.Fatalf("expected ErrConnectTimeout, got: %v", err)
+	}
+
+	// the server is told to forget the session, in case only the ack was
+	// lost
+	id := s.acceptConnect()
+	if got, want := s.receive(), fmt.Sprintf("/close/%d/", id); got != want {
+		t.Fatalf("wrong packet. expected: %q, got: %q", want, got)
+	}
+}
+
+func TestDialContextCancelled(t *testing.T) {
+
+	s := newRawServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var d Dialer
+	if _, err := d.DialContext(ctx, s.pc.LocalAddr().String()); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	}
+}
+
+func TestDialSessionExpires(t *testing.T) {
+
+	clk := clock.NewFake(time.Unix(0, 0))
+	s := newRawServer(t)
+	d := &Dialer{Clock: clk, SessionTimeout: time.Minute}
+
+	dialed := make(chan net.Conn, 1)
+	go func() {
+		c, err := d.Dial(s.pc.LocalAddr().String())
+		if err != nil {
+			t.Error(err)
+		}
+		dialed <- c
+	}()
+	id := s.acceptConnect()
+	s.send("/ack/%d/0/", id)
+	c := <-dialed
+	if c == nil {
+		return
+	}
+
+	clk.Advance(time.Minute)
+	if got, want := s.receive(), fmt.Sprintf("/close/%d/", id); got != want {
+		t.Fatalf("wrong packet. expected: %q, got: %q", want, got)
+	}
+	if _, err := c.Read(make([]byte, 1)); err != ErrSessionExpired {
+		t.Fatalf("expected ErrSessionExpired, got: %v", err)
+	}
+}
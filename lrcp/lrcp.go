@@ -0,0 +1,324 @@
+// Package lrcp implements the Line Reversal Control Protocol, a reliable byte
+// stream over UDP. A Listener accepts sessions as net.Conn values, so any
+// handler written for TCP can serve LRCP clients unchanged; Dial opens a
+// session to a server.
+//
+// Every packet is one message:
+//
+//	/connect/SESSION/
+//	/data/SESSION/POS/DATA/
+//	/ack/SESSION/LENGTH/
+//	/close/SESSION/
+//
+// Data the peer does not acknowledge within the retransmission timeout is
+// sent again. A session the peer has not sent anything to for the session
+// timeout is closed.
+package lrcp
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mehix/protohackers/clock"
+	"github.com/mehix/protohackers/metrics"
+)
+
+// defaultRetransmitTimeout is how long a packet waits for its ack before it
+// is sent again, unless configured otherwise.
+const defaultRetransmitTimeout = 3 * time.Second
+
+// defaultSessionTimeout is how long a silent peer keeps its session open,
+// unless configured otherwise.
+const defaultSessionTimeout = 60 * time.Second
+
+// acceptBacklog is how many new sessions may wait for Accept. Connects
+// beyond it are not acknowledged, so the peer tries again later.
+const acceptBacklog = 128
+
+// ListenConfig holds the options of a Listener. The zero value is ready to
+// use.
+type ListenConfig struct {
+	// RetransmitTimeout is how long a packet waits for its ack before it is
+	// sent again. Zero means 3 seconds.
+	RetransmitTimeout time.Duration
+
+	// SessionTimeout is how long a session stays open without any packet
+	// from the peer. Zero means 60 seconds.
+	SessionTimeout time.Duration
+
+	// Clock times the retransmissions and the session timeouts. Nil means
+	// the real clock.
+	Clock clock.Clock
+
+	// Logger logs the listener and, with the session ID added, each
+	// session. Nil means slog.Default().
+	Logger *slog.Logger
+
+	// Metrics receives the session and packet counts. Nil disables them.
+	Metrics *metrics.Registry
+}
+
+// Listen accepts LRCP sessions on the UDP address addr.
+func Listen(addr string) (net.Listener, error) {
+	var lc ListenConfig
+	return lc.Listen(addr)
+}
+
+// Listen accepts LRCP sessions on the UDP address addr.
+func (lc *ListenConfig) Listen(addr string) (net.Listener, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return lc.NewListener(pc), nil
+}
+
+// NewListener accepts LRCP sessions on pc. pc is closed once the Listener
+// and all its sessions are closed.
+func (lc *ListenConfig) NewListener(pc net.PacketConn) *Listener {
+	l := &Listener{
+		endpoint: newEndpoint(pc, lc.RetransmitTimeout, lc.SessionTimeout, lc.Clock, lc.Logger, lc.Metrics),
+		accept:   make(chan *Conn, acceptBacklog),
+		done:     make(chan struct{}),
+		sessions: make(map[int]*Conn),
+	}
+	lc.Metrics.GaugeFunc("lrcp_sessions_active", "Open sessions.", func() int64 {
+		l.m.Lock()
+		defer l.m.Unlock()
+		return int64(len(l.sessions))
+	})
+
+	go l.serve()
+	return l
+}
+
+// stats count the traffic of a Listener.
+type stats struct {
+	sessions        *metrics.Counter
+	expired         *metrics.Counter
+	retransmissions *metrics.Counter
+	packetsIn       *metrics.Counter
+	packetsOut      *metrics.Counter
+	discarded       *metrics.Counter
+	bytesIn         *metrics.Counter
+	bytesOut        *metrics.Counter
+}
+
+func newStats(r *metrics.Registry) stats {
+	return stats{
+		sessions:        r.Counter("lrcp_sessions_total", "Sessions opened."),
+		expired:         r.Counter("lrcp_sessions_expired_total", "Sessions closed because the peer went silent."),
+		retransmissions: r.Counter("lrcp_retransmissions_total", "Data packets sent again for lack of an ack."),
+		packetsIn:       r.Counter("lrcp_packets_received_total", "Packets received."),
+		packetsOut:      r.Counter("lrcp_packets_sent_total", "Packets sent."),
+		discarded:       r.Counter("lrcp_packets_discarded_total", "Packets received and ignored as invalid."),
+		bytesIn:         r.Counter("lrcp_packet_bytes_received_total", "Bytes of the packets received."),
+		bytesOut:        r.Counter("lrcp_packet_bytes_sent_total", "Bytes of the packets sent."),
+	}
+}
+
+// endpoint is the UDP socket the packets of one or more sessions go through.
+type endpoint struct {
+	pc     net.PacketConn
+	rto    time.Duration // retransmission timeout
+	expiry time.Duration // session timeout
+	clock  clock.Clock
+	log    *slog.Logger
+	stats  stats
+}
+
+func newEndpoint(pc net.PacketConn, rto, expiry time.Duration, clk clock.Clock, log *slog.Logger, reg *metrics.Registry) *endpoint {
+	if rto <= 0 {
+		rto = defaultRetransmitTimeout
+	}
+	if expiry <= 0 {
+		expiry = defaultSessionTimeout
+	}
+	if log == nil {
+		log = slog.Default()
+	}
+	return &endpoint{pc: pc, rto: rto, expiry: expiry, clock: clock.Or(clk), log: log, stats: newStats(reg)}
+}
+
+// serve reads packets until pc is closed and passes the valid ones to
+// handle. stopped tells whether pc was closed on purpose.
+func (e *endpoint) serve(handle func(m message, addr net.Addr), stopped func() bool) {
+	ctx := context.Background()
+	buf := make([]byte, maxPacket+1)
+	for {
+		n, addr, err := e.pc.ReadFrom(buf)
+		if err != nil {
+			if !stopped() {
+				e.log.Error("reading packets", "err", err)
+			}
+			return
+		}
+
+		e.stats.packetsIn.Inc()
+		e.stats.bytesIn.Add(uint64(n))
+		packet := buf[:n]
+		if e.log.Enabled(ctx, slog.LevelDebug) {
+			e.log.LogAttrs(ctx, slog.LevelDebug, "packet received", slog.String("remote", addr.String()), slog.String("data", string(packet)))
+		}
+
+		if n >= maxPacket {
+			e.discard(addr, "packet too long")
+			continue
+		}
+		m, err := parse(packet)
+		if err != nil {
+			e.discard(addr, err.Error())
+			continue
+		}
+		handle(m, addr)
+	}
+}
+
+func (e *endpoint) discard(addr net.Addr, reason string) {
+	e.stats.discarded.Inc()
+	e.log.Debug("packet discarded", "remote", addr.String(), "reason", reason)
+}
+
+// send writes one packet to addr.
+func (e *endpoint) send(addr net.Addr, packet []byte) {
+	ctx := context.Background()
+	if e.log.Enabled(ctx, slog.LevelDebug) {
+		e.log.LogAttrs(ctx, slog.LevelDebug, "packet sent", slog.String("remote", addr.String()), slog.String("data", string(packet)))
+	}
+	if _, err := e.pc.WriteTo(packet, addr); err != nil {
+		e.log.Warn("packet not sent", "remote", addr.String(), "err", err)
+		return
+	}
+	e.stats.packetsOut.Inc()
+	e.stats.bytesOut.Add(uint64(len(packet)))
+}
+
+// Listener is a net.Listener for LRCP sessions. Closing it stops accepting
+// new sessions; the sessions already accepted keep working until they are
+// closed, like TCP connections do.
+type Listener struct {
+	*endpoint
+	accept chan *Conn
+
+	closeOnce sync.Once
+	done      chan struct{} // closed by Close
+
+	m        sync.Mutex
+	sessions map[int]*Conn // session ID => open session
+	closed   bool
+}
+
+// Accept waits for the next session.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting sessions. Sessions not accepted yet are closed.
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+
+		l.m.Lock()
+		l.closed = true
+		l.m.Unlock()
+
+		for drained := false; !drained; {
+			select {
+			case c := <-l.accept:
+				c.Close()
+			default:
+				drained = true
+			}
+		}
+
+		l.m.Lock()
+		defer l.m.Unlock()
+		if len(l.sessions) == 0 {
+			l.pc.Close()
+		}
+	})
+	return nil
+}
+
+// Addr returns the UDP address of the listener.
+func (l *Listener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+// serve handles packets until pc is closed.
+func (l *Listener) serve() {
+	l.endpoint.serve(l.handle, func() bool {
+		l.m.Lock()
+		defer l.m.Unlock()
+		return l.closed && len(l.sessions) == 0
+	})
+}
+
+func (l *Listener) handle(m message, addr net.Addr) {
+	if m.kind == kindConnect {
+		c := l.open(m.session, addr)
+		if c != nil {
+			c.handle(m)
+		}
+		return
+	}
+
+	l.m.Lock()
+	c := l.sessions[m.session]
+	l.m.Unlock()
+	if c == nil {
+		l.send(addr, closeMsg(m.session))
+		return
+	}
+	c.handle(m)
+}
+
+// open returns the session with the given ID, creating it and queueing it
+// for Accept if it is new. It returns nil for a new session that cannot be
+// accepted now.
+func (l *Listener) open(id int, addr net.Addr) *Conn {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if c, ok := l.sessions[id]; ok {
+		return c
+	}
+	if l.closed {
+		return nil
+	}
+
+	// checked before the session exists, so a connect ignored leaves no
+	// timer behind; only open sends to accept, so the room stays
+	if len(l.accept) == cap(l.accept) {
+		l.log.Warn("accept backlog full, ignoring connect", "session", id, "remote", addr.String())
+		return nil
+	}
+	c := newConn(l.endpoint, id, addr, l.remove)
+	l.accept <- c
+
+	l.sessions[id] = c
+	l.stats.sessions.Inc()
+	c.start()
+	return c
+}
+
+// remove forgets a session that ended.
+func (l *Listener) remove(c *Conn) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.sessions[c.id] == c {
+		delete(l.sessions, c.id)
+	}
+	if l.closed && len(l.sessions) == 0 {
+		l.pc.Close()
+	}
+}
@@ -0,0 +1,611 @@
+package lrcp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mehix/protohackers/clock"
+	"github.com/mehix/protohackers/metrics"
+	"github.com/mehix/protohackers/server"
+)
+
+// peer is the client side of a test, speaking raw LRCP packets.
+type peer struct {
+	t    *testing.T
+	pc   net.PacketConn
+	addr net.Addr
+}
+
+func newPeer(t *testing.T, l net.Listener) *peer {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return &peer{t: t, pc: pc, addr: l.Addr()}
+}
+
+func (p *peer) send(packet string) {
+	p.t.Helper()
+	if _, err := p.pc.WriteTo([]byte(packet), p.addr); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// receive returns the next packet, or "" if none arrives within timeout.
+func (p *peer) receive(timeout time.Duration) string {
+	p.t.Helper()
+
+	buf := make([]byte, maxPacket)
+	p.pc.SetReadDeadline(time.Now().Add(timeout))
+	n, _, err := p.pc.ReadFrom(buf)
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return ""
+		}
+		p.t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func (p *peer) expect(packet string) {
+	p.t.Helper()
+	if got := p.receive(time.Second); got != packet {
+		p.t.Fatalf("wrong packet. expected: %q, got: %q", packet, got)
+	}
+}
+
+func (p *peer) expectNothing() {
+	p.t.Helper()
+	if got := p.receive(50 * time.Millisecond); got != "" {
+		p.t.Fatalf("expected no packet, got: %q", got)
+	}
+}
+
+func listen(t *testing.T, lc ListenConfig) *Listener {
+	t.Helper()
+
+	l, err := lc.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l.(*Listener)
+}
+
+// echo accepts sessions and echoes what they receive until the listener is
+// closed.
+func echo(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			io.Copy(c, c)
+		}()
+	}
+}
+
+func TestEchoSession(t *testing.T) {
+
+	l := listen(t, ListenConfig{})
+	go echo(l)
+	p := newPeer(t, l)
+
+	p.send("/connect/12345/")
+	p.expect("/ack/12345/0/")
+
+	// a repeated connect is acknowledged again
+	p.send("/connect/12345/")
+	p.expect("/ack/12345/0/")
+
+	p.send("/data/12345/0/hello\n/")
+	p.expect("/ack/12345/6/")
+	p.expect("/data/12345/0/hello\n/")
+	p.send("/ack/12345/6/")
+
+	p.send(`/data/12345/6/a\/b\\c/`)
+	p.expect("/ack/12345/11/")
+	p.expect(`/data/12345/6/a\/b\\c/`)
+	p.send("/ack/12345/11/")
+
+	p.send("/close/12345/")
+	p.expect("/close/12345/")
+	p.expectNothing()
+}
+
+func TestUnknownSessionIsClosed(t *testing.T) {
+
+	l := listen(t, ListenConfig{})
+	p := newPeer(t, l)
+
+	p.send("/data/7/0/hello/")
+	p.expect("/close/7/")
+	p.send("/ack/7/0/")
+	p.expect("/close/7/")
+}
+
+func TestDataOutOfOrder(t *testing.T) {
+
+	l := listen(t, ListenConfig{})
+	p := newPeer(t, l)
+
+	p.send("/connect/1/")
+	p.expect("/ack/1/0/")
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a gap is answered with the length received so far
+	p.send("/data/1/3/def/")
+	p.expect("/ack/1/0/")
+	p.send("/data/1/0/abc/")
+	p.expect("/ack/1/3/")
+	// so is data received twice
+	p.send("/data/1/0/abc/")
+	p.expect("/ack/1/3/")
+
+	buf := make([]byte, 10)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "abc" {
+		t.Fatalf("wrong data. expected: %q, got: %q", "abc", buf[:n])
+	}
+}
+
+func TestInvalidPacketsIgnored(t *testing.T) {
+
+	reg := metrics.NewRegistry()
+	l := listen(t, ListenConfig{Metrics: reg})
+	p := newPeer(t, l)
+
+	p.send("/connect/1/")
+	p.expect("/ack/1/0/")
+
+	for _, packet := range []string{
+		"hello",
+		"/connect/",
+		"/connect/x/",
+		"/connect/2147483648/",
+		"/ack/1/",
+		"/ack/1/2/3/",
+		"/data/1/0/a/b/",
+		`/data/1/0/a\b/`,
+		"/data/1/0/abc",
+		"/close/1",
+		"/data/1/0/" + strings.Repeat("a", maxPacket) + "/",
+	} {
+		p.send(packet)
+		p.expectNothing()
+	}
+
+	if n := reg.Counter("lrcp_packets_discarded_total", "").Value(); n != 11 {
+		t.Fatalf("expected 11 discarded packets, got %d", n)
+	}
+}
+
+func TestAckBeyondSentCloses(t *testing.T) {
+
+	l := listen(t, ListenConfig{})
+	p := newPeer(t, l)
+
+	p.send("/connect/1/")
+	p.expect("/ack/1/0/")
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.send("/ack/1/5/")
+	p.expect("/close/1/")
+
+	if _, err := c.Write([]byte("late")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected net.ErrClosed, got: %v", err)
+	}
+}
+
+func TestPeerCloseEndsReads(t *testing.T) {
+
+	l := listen(t, ListenConfig{})
+	p := newPeer(t, l)
+
+	p.send("/connect/1/")
+	p.expect("/ack/1/0/")
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.send("/data/1/0/bye/")
+	p.expect("/ack/1/3/")
+	p.send("/close/1/")
+	p.expect("/close/1/")
+
+	data, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "bye" {
+		t.Fatalf("wrong data. expected: %q, got: %q", "bye", data)
+	}
+	if _, err := c.Write([]byte("x")); err != ErrClosedByPeer {
+		t.Fatalf("expected ErrClosedByPeer, got: %v", err)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+
+	l := listen(t, ListenConfig{})
+	p := newPeer(t, l)
+
+	p.send("/connect/1/")
+	p.expect("/ack/1/0/")
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		done <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	c.SetReadDeadline(time.Now())
+
+	select {
+	case err := <-done:
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() {
+			t.Fatalf("expected a timeout, got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read not interrupted by the deadline")
+	}
+}
+
+func TestRetransmitUntilAcknowledged(t *testing.T) {
+
+	clk := clock.NewFake(time.Unix(0, 0))
+	reg := metrics.NewRegistry()
+	l := listen(t, ListenConfig{Clock: clk, Metrics: reg})
+	p := newPeer(t, l)
+
+	p.send("/connect/12345/")
+	p.expect("/ack/12345/0/")
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Write([]byte("olleh\n"))
+	p.expect("/data/12345/0/olleh\n/")
+
+	// not acknowledged, so sent again once the timeout expired
+	clk.Advance(defaultRetransmitTimeout)
+	p.expect("/data/12345/0/olleh\n/")
+	if n := reg.Counter("lrcp_retransmissions_total", "").Value(); n != 1 {
+		t.Fatalf("expected 1 retransmission counted, got %d", n)
+	}
+
+	p.send("/ack/12345/6/")
+	time.Sleep(20 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		clk.Advance(defaultRetransmitTimeout)
+	}
+	p.expectNothing()
+}
+
+func TestRetransmitTimeoutPerPacket(t *testing.T) {
+
+	clk := clock.NewFake(time.Unix(0, 0))
+	l := listen(t, ListenConfig{Clock: clk, RetransmitTimeout: 3 * time.Second})
+	p := newPeer(t, l)
+
+	p.send("/connect/1/")
+	p.expect("/ack/1/0/")
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Write([]byte("a"))
+	p.expect("/data/1/0/a/")
+	clk.Advance(time.Second)
+	c.Write([]byte("b"))
+	p.expect("/data/1/1/b/")
+
+	// each packet is sent again 3 seconds after it was last sent
+	clk.Advance(2 * time.Second)
+	p.expect("/data/1/0/a/")
+	p.expectNothing()
+	clk.Advance(time.Second)
+	p.expect("/data/1/1/b/")
+	p.expectNothing()
+
+	// acknowledged packets are not
+	p.send("/ack/1/1/")
+	time.Sleep(20 * time.Millisecond)
+	clk.Advance(2 * time.Second)
+	p.expectNothing()
+	clk.Advance(time.Second)
+	p.expect("/data/1/1/b/")
+}
+
+func TestFlushWaitsForAcks(t *testing.T) {
+
+	l := listen(t, ListenConfig{})
+	p := newPeer(t, l)
+
+	p.send("/connect/1/")
+	p.expect("/ack/1/0/")
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := c.(*Conn)
+
+	conn.Write([]byte("hello"))
+	p.expect("/data/1/0/hello/")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := conn.Flush(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the flush to time out without an ack, got: %v", err)
+	}
+
+	flushed := make(chan error, 1)
+	go func() { flushed <- conn.Flush(context.Background()) }()
+	p.send("/ack/1/3/")
+	select {
+	case err := <-flushed:
+		t.Fatalf("flushed before everything was acknowledged: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	p.send("/ack/1/5/")
+	select {
+	case err := <-flushed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("flush not done once everything was acknowledged")
+	}
+
+	conn.Write([]byte("x"))
+	p.expect("/data/1/5/x/")
+	go func() { flushed <- conn.Flush(context.Background()) }()
+	p.send("/close/1/")
+	if err := <-flushed; err != ErrClosedByPeer {
+		t.Fatalf("expected ErrClosedByPeer, got: %v", err)
+	}
+}
+
+func TestWriteSplitsAtPacketLimit(t *testing.T) {
+
+	l := listen(t, ListenConfig{})
+	p := newPeer(t, l)
+
+	p.send("/connect/1/")
+	p.expect("/ack/1/0/")
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// slashes double in size once escaped
+	data := strings.Repeat("ab/", 1000)
+	c.Write([]byte(data))
+
+	var received []byte
+	for len(received) < len(data) {
+		packet := p.receive(time.Second)
+		if len(packet) >= maxPacket {
+			t.Fatalf("packet of %d bytes", len(packet))
+		}
+		m, err := parse([]byte(packet))
+		if err != nil {
+			t.Fatalf("invalid packet %q: %v", packet, err)
+		}
+		if m.pos != len(received) {
+			t.Fatalf("packet at %d, expected %d", m.pos, len(received))
+		}
+		received = append(received, m.data...)
+	}
+	if string(received) != data {
+		t.Fatal("data mangled")
+	}
+}
+
+func TestSplit(t *testing.T) {
+
+	// the longest headers
+	const start = maxNumber - 10000
+
+	for _, data := range []string{"", "a", strings.Repeat("a", 2000), strings.Repeat("/", 2000), strings.Repeat(`\a`, 700)} {
+		pos := start
+		for _, ch := range split(maxNumber, pos, []byte(data)) {
+			if ch.pos != pos || ch.end <= ch.pos {
+				t.Fatalf("wrong chunk %d-%d after %d", ch.pos, ch.end, pos)
+			}
+			n := len(dataMsg(maxNumber, ch.pos, []byte(data[ch.pos-start:ch.end-start])))
+			if n >= maxPacket {
+				t.Fatalf("packet of %d bytes", n)
+			}
+			if ch.end-start < len(data) && n < maxPacket-2 {
+				t.Fatalf("packet of %d bytes could hold more", n)
+			}
+			pos = ch.end
+		}
+		if pos-start != len(data) {
+			t.Fatalf("chunks cover %d bytes out of %d", pos-start, len(data))
+		}
+	}
+}
+
+func TestSessionExpires(t *testing.T) {
+
+	clk := clock.NewFake(time.Unix(0, 0))
+	reg := metrics.NewRegistry()
+	l := listen(t, ListenConfig{Clock: clk, SessionTimeout: time.Minute, Metrics: reg})
+	p := newPeer(t, l)
+
+	p.send("/connect/1/")
+	p.expect("/ack/1/0/")
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// any packet from the peer keeps the session open
+	clk.Advance(30 * time.Second)
+	p.send("/data/1/0/hi/")
+	p.expect("/ack/1/2/")
+	clk.Advance(59 * time.Second)
+	p.expectNothing()
+
+	clk.Advance(time.Second)
+	p.expect("/close/1/")
+
+	buf := make([]byte, 10)
+	if n, err := c.Read(buf); err != nil || string(buf[:n]) != "hi" {
+		t.Fatalf("expected the data received before expiry, got: %q, %v", buf[:n], err)
+	}
+	if _, err := c.Read(buf); err != ErrSessionExpired {
+		t.Fatalf("expected ErrSessionExpired, got: %v", err)
+	}
+	if _, err := c.Write([]byte("x")); err != ErrSessionExpired {
+		t.Fatalf("expected ErrSessionExpired, got: %v", err)
+	}
+
+	// the session is forgotten
+	p.send("/data/1/2/x/")
+	p.expect("/close/1/")
+	if n := reg.Counter("lrcp_sessions_expired_total", "").Value(); n != 1 {
+		t.Fatalf("expected 1 expired session counted, got %d", n)
+	}
+	var out bytes.Buffer
+	reg.WriteTo(&out)
+	if !strings.Contains(out.String(), "lrcp_sessions_active 0\n") {
+		t.Fatalf("session still counted as active:\n%s", out.String())
+	}
+}
+
+func TestSessionTimerArmedOnStart(t *testing.T) {
+
+	clk := clock.NewFake(time.Unix(0, 0))
+	ep := newEndpoint(nil, 0, time.Minute, clk, nil, nil)
+	c := newConn(ep, 1, &net.UDPAddr{}, func(*Conn) {})
+	if n := clk.Waiters(); n != 0 {
+		t.Fatalf("session timer armed before the session is registered: %d timers", n)
+	}
+
+	c.start()
+	if n := clk.Waiters(); n != 1 {
+		t.Fatalf("expected the session timer armed, got %d timers", n)
+	}
+	c.end()
+	if n := clk.Waiters(); n != 0 {
+		t.Fatalf("session timer left armed after the session ended: %d timers", n)
+	}
+}
+
+func TestConnectIgnoredWhenBacklogFull(t *testing.T) {
+
+	clk := clock.NewFake(time.Unix(0, 0))
+	l := listen(t, ListenConfig{Clock: clk, SessionTimeout: time.Minute})
+	p := newPeer(t, l)
+
+	for id := 0; id < acceptBacklog; id++ {
+		p.send(fmt.Sprintf("/connect/%d/", id))
+		p.expect(fmt.Sprintf("/ack/%d/0/", id))
+	}
+	p.send("/connect/1000/")
+	p.expectNothing()
+
+	// the sessions waiting for Accept expire, the ignored one never existed
+	clk.Advance(time.Minute)
+	for packet := p.receive(100 * time.Millisecond); packet != ""; packet = p.receive(100 * time.Millisecond) {
+		if packet == "/close/1000/" {
+			t.Fatal("ignored connect closed after the session timeout")
+		}
+	}
+}
+
+func TestListenerCloseKeepsSessions(t *testing.T) {
+
+	l := listen(t, ListenConfig{})
+	p := newPeer(t, l)
+
+	p.send("/connect/1/")
+	p.expect("/ack/1/0/")
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.Close()
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected net.ErrClosed, got: %v", err)
+	}
+
+	// no new sessions
+	p.send("/connect/2/")
+	p.expectNothing()
+
+	// the open one still works
+	p.send("/data/1/0/hi/")
+	p.expect("/ack/1/2/")
+	c.Write([]byte("ho"))
+	p.expect("/data/1/0/ho/")
+
+	c.Close()
+	p.expect("/close/1/")
+}
+
+func TestServeOverServer(t *testing.T) {
+
+	l := listen(t, ListenConfig{})
+	srv := &server.Server{
+		ShutdownTimeout: time.Second,
+		Handler: server.HandlerFunc(func(_ context.Context, conn net.Conn) {
+			io.Copy(conn, conn)
+		}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- srv.Serve(ctx, l) }()
+
+	p := newPeer(t, l)
+	p.send("/connect/9/")
+	p.expect("/ack/9/0/")
+	p.send("/data/9/0/ping/")
+	p.expect("/ack/9/4/")
+	p.expect("/data/9/0/ping/")
+	p.send("/ack/9/4/")
+
+	// shutting down interrupts the handler, which closes the session
+	cancel()
+	p.expect("/close/9/")
+	if err := <-errs; err != server.ErrServerClosed {
+		t.Fatalf("wrong error. expected: %v, got: %v", server.ErrServerClosed, err)
+	}
+}
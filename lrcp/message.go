@@ -0,0 +1,172 @@
+package lrcp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// maxPacket is the size every LRCP packet stays below.
+const maxPacket = 1000
+
+// maxNumber bounds session IDs, positions and lengths.
+const maxNumber = 1<<31 - 1
+
+type kind string
+
+const (
+	kindConnect kind = "connect"
+	kindData    kind = "data"
+	kindAck     kind = "ack"
+	kindClose   kind = "close"
+)
+
+// fields is the number of fields of each kind of message, its name included.
+var fields = map[kind]int{
+	kindConnect: 2,
+	kindData:    4,
+	kindAck:     3,
+	kindClose:   2,
+}
+
+// message is one parsed packet.
+type message struct {
+	kind    kind
+	session int
+	pos     int    // position of data, length of an ack
+	data    []byte // unescaped payload of data
+}
+
+// parse decodes a packet. Invalid packets are meant to be ignored: a packet
+// is valid only if it starts and ends with a slash, has the fields its kind
+// calls for, numbers made of digits below 2147483648, and data whose slashes
+// and backslashes are all escaped.
+func parse(b []byte) (message, error) {
+	var m message
+
+	if len(b) < 2 || b[0] != '/' || b[len(b)-1] != '/' {
+		return m, errors.New("not enclosed in slashes")
+	}
+	parts, err := splitFields(b[1 : len(b)-1])
+	if err != nil {
+		return m, err
+	}
+
+	m.kind = kind(parts[0])
+	n, ok := fields[m.kind]
+	if !ok {
+		return m, fmt.Errorf("unknown message %q", parts[0])
+	}
+	if len(parts) != n {
+		return m, fmt.Errorf("%s with %d fields instead of %d", m.kind, len(parts), n)
+	}
+
+	if m.session, err = number(parts[1]); err != nil {
+		return m, err
+	}
+	if n > 2 {
+		if m.pos, err = number(parts[2]); err != nil {
+			return m, err
+		}
+	}
+	if m.kind == kindData {
+		m.data = unescape(parts[3])
+	}
+	return m, nil
+}
+
+// splitFields cuts the inside of a packet at its unescaped slashes, checking
+// the escapes on the way.
+func splitFields(b []byte) ([][]byte, error) {
+	var parts [][]byte
+	start := 0
+	for i := 0; i < len(b); i++ {
+		switch b[i] {
+		case '/':
+			parts = append(parts, b[start:i])
+			start = i + 1
+		case '\\':
+			if i+1 == len(b) || (b[i+1] != '\\' && b[i+1] != '/') {
+				return nil, errors.New("invalid escape")
+			}
+			i++
+		}
+	}
+	return append(parts, b[start:]), nil
+}
+
+// number parses a field made only of digits, up to maxNumber.
+func number(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, errors.New("empty number")
+	}
+	n := 0
+	for _, d := range b {
+		if d < '0' || d > '9' {
+			return 0, fmt.Errorf("invalid number %q", b)
+		}
+		n = n*10 + int(d-'0')
+		if n > maxNumber {
+			return 0, fmt.Errorf("number out of range: %s", b)
+		}
+	}
+	return n, nil
+}
+
+// unescape undoes escape on data splitFields already checked.
+func unescape(b []byte) []byte {
+	if bytes.IndexByte(b, '\\') < 0 {
+		return b
+	}
+
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if b[i] == '\\' {
+			i++
+		}
+		out = append(out, b[i])
+	}
+	return out
+}
+
+func escape(b []byte) []byte {
+	b = bytes.ReplaceAll(b, []byte(`\`), []byte(`\\`))
+	b = bytes.ReplaceAll(b, []byte(`/`), []byte(`\/`))
+	return b
+}
+
+// encode returns the packet of m.
+func (m message) encode() []byte {
+	b := make([]byte, 0, 32+len(m.data))
+	b = append(b, '/')
+	b = append(b, m.kind...)
+	b = append(b, '/')
+	b = strconv.AppendInt(b, int64(m.session), 10)
+	b = append(b, '/')
+	if m.kind == kindData || m.kind == kindAck {
+		b = strconv.AppendInt(b, int64(m.pos), 10)
+		b = append(b, '/')
+	}
+	if m.kind == kindData {
+		b = append(b, escape(m.data)...)
+		b = append(b, '/')
+	}
+	return b
+}
+
+func connectMsg(session int) []byte {
+	return message{kind: kindConnect, session: session}.encode()
+}
+
+func closeMsg(session int) []byte {
+	return message{kind: kindClose, session: session}.encode()
+}
+
+func ackMsg(session, length int) []byte {
+	return message{kind: kindAck, session: session, pos: length}.encode()
+}
+
+func dataMsg(session, pos int, data []byte) []byte {
+	return message{kind: kindData, session: session, pos: pos, data: data}.encode()
+}
@@ -0,0 +1,136 @@
+package lrcp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+
+	type scenario struct {
+		packet string
+		msg    message
+		err    bool
+	}
+
+	scenarios := []scenario{
+		{packet: "/connect/12345/", msg: message{kind: kindConnect, session: 12345}},
+		{packet: "/close/0/", msg: message{kind: kindClose}},
+		{packet: "/ack/1/2147483647/", msg: message{kind: kindAck, session: 1, pos: maxNumber}},
+		{packet: "/data/1/0/hello, world!\n/", msg: message{kind: kindData, session: 1, data: []byte("hello, world!\n")}},
+		{packet: `/data/1/5/a\/b\\c/`, msg: message{kind: kindData, session: 1, pos: 5, data: []byte(`a/b\c`)}},
+		{packet: "/data/1/0//", msg: message{kind: kindData, session: 1, data: []byte{}}},
+		{packet: "/connect/007/", msg: message{kind: kindConnect, session: 7}},
+
+		{packet: "", err: true},
+		{packet: "/", err: true},
+		{packet: "//", err: true},
+		{packet: "connect/1/", err: true},
+		{packet: "/connect/1", err: true},
+		{packet: "/connect/", err: true},
+		{packet: "/connect//", err: true},
+		{packet: "/connect/1/2/", err: true},
+		{packet: "/connect/-1/", err: true},
+		{packet: "/connect/+1/", err: true},
+		{packet: "/connect/1 /", err: true},
+		{packet: "/connect/2147483648/", err: true},
+		{packet: "/connect/99999999999999999999999/", err: true},
+		{packet: "/ack/1/", err: true},
+		{packet: "/ack/1/2/3/", err: true},
+		{packet: "/close/1/x/", err: true},
+		{packet: "/data/1/0/", err: true},
+		{packet: "/data/1/0/a/b/", err: true},
+		{packet: `/data/1/0/a\b/`, err: true},
+		{packet: `/data/1/0/a\/`, err: true},
+		{packet: "/data/1/2147483648/a/", err: true},
+		{packet: "/hello/1/", err: true},
+		{packet: "/Connect/1/", err: true},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.packet, func(t *testing.T) {
+			m, err := parse([]byte(s.packet))
+			if s.err {
+				if err == nil {
+					t.Fatalf("parsing should fail, got: %+v", m)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsing should not fail: %v", err)
+			}
+			if !equal(m, s.msg) {
+				t.Fatalf("wrong message. expected: %+v, got: %+v", s.msg, m)
+			}
+		})
+	}
+}
+
+func equal(a, b message) bool {
+	return a.kind == b.kind && a.session == b.session && a.pos == b.pos && bytes.Equal(a.data, b.data)
+}
+
+// FuzzParse checks that whatever parse accepts encodes back to a packet
+// parsing to the same message.
+func FuzzParse(f *testing.F) {
+	for _, packet := range []string{
+		"/connect/12345/",
+		"/close/1/",
+		"/ack/1/2147483647/",
+		`/data/1/5/a\/b\\c/`,
+		"/data/1/0//",
+		"/data/1/0/a/b/",
+		`/data/1/0/a\/`,
+	} {
+		f.Add([]byte(packet))
+	}
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		m, err := parse(packet)
+		if err != nil {
+			return
+		}
+		encoded := m.encode()
+		again, err := parse(encoded)
+		if err != nil {
+			t.Fatalf("%q parsed, but not its encoding %q: %v", packet, encoded, err)
+		}
+		if !equal(m, again) {
+			t.Fatalf("%q parsed to %+v, its encoding %q to %+v", packet, m, encoded, again)
+		}
+	})
+}
+
+// FuzzEncode checks that every message encodes to a packet parsing back to
+// it.
+func FuzzEncode(f *testing.F) {
+	f.Add(uint8(0), uint32(12345), uint32(0), []byte(nil))
+	f.Add(uint8(1), uint32(1), uint32(6), []byte("hello\n"))
+	f.Add(uint8(1), uint32(maxNumber), uint32(maxNumber), []byte(`/\//\\`))
+	f.Add(uint8(2), uint32(1), uint32(6), []byte(nil))
+	f.Add(uint8(3), uint32(1), uint32(0), []byte(nil))
+
+	kinds := []kind{kindConnect, kindData, kindAck, kindClose}
+	f.Fuzz(func(t *testing.T, k uint8, session, pos uint32, data []byte) {
+		m := message{kind: kinds[int(k)%len(kinds)], session: int(session % (maxNumber + 1))}
+		switch m.kind {
+		case kindData:
+			m.pos = int(pos % (maxNumber + 1))
+			m.data = data
+			if m.data == nil {
+				m.data = []byte{}
+			}
+		case kindAck:
+			m.pos = int(pos % (maxNumber + 1))
+		}
+
+		encoded := m.encode()
+		got, err := parse(encoded)
+		if err != nil {
+			t.Fatalf("%+v encoded to %q, which does not parse: %v", m, encoded, err)
+		}
+		if !equal(m, got) {
+			t.Fatalf("%+v encoded to %q, which parses to %+v", m, encoded, got)
+		}
+	})
+}
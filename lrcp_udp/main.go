@@ -1,129 +1,71 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"context"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"os"
-	"regexp"
-	"strconv"
+	"time"
+
+	"github.com/mehix/protohackers/logging"
+	"github.com/mehix/protohackers/lrcp"
+	"github.com/mehix/protohackers/server"
+)
+
+var (
+	retransmitTimeout = flag.Duration("retransmit-timeout", 3*time.Second, "time a packet waits for its ack before it is sent again")
+	sessionTimeout    = flag.Duration("session-timeout", time.Minute, "time a session stays open without hearing from the peer")
+	serverConfig      = server.Flags(flag.CommandLine)
+	logConfig         = logging.Flags(flag.CommandLine)
 )
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: lrcp <addr>")
+	flag.Parse()
+	logConfig.Install()
+	if flag.NArg() < 1 {
+		fmt.Println("Usage: lrcp [flags] <addr>")
 		os.Exit(1)
 	}
 
-	app := NewApp()
-
-	if err := startServer(app, os.Args[1]); err != nil {
-		log.Fatal(err)
-	}
-}
-
-var msgConnect = regexp.MustCompile("^/connect/([0-9]+)/$")
-var msgClose = regexp.MustCompile("^/close/([0-9]*)/$")
-var msgAck = regexp.MustCompile("^/ack/([0-9]+)/([0-9]+)/$")
-var msgData = regexp.MustCompile("^/data/([0-9]+)/([0-9]+)/([/\\a-zA-Z0-9\r\n]+)")
+	ctx, stop := server.SignalContext()
+	defer stop()
 
-func startServer(app *Application, addr string) error {
-	l, err := net.ListenPacket("udp", addr)
+	reg, err := serverConfig.Metrics(ctx)
 	if err != nil {
-		return err
+		slog.Error("starting metrics endpoint", "err", err)
+		os.Exit(1)
 	}
-	defer l.Close()
-
-	buff := make([]byte, 1024)
-	for {
-		//fmt.Println("waiting for packets")
-		n, remoteAddr, err := l.ReadFrom(buff)
-		if err != nil {
-			return err
-		}
-
-		if n > 1000 {
-			// discard long messages
-			continue
-		}
-
-		log.Printf("%s --> %s\n", remoteAddr.String(), buff[:n])
-
-		if msgConnect.Match(buff[:n]) {
-			parts := msgConnect.FindAllSubmatch(buff[:n], -1)[0]
-			sessionID := string(parts[1])
-			if !app.IsConnected(sessionID) {
-				app.StartSession(sessionID, l, remoteAddr)
-			}
-			ackMsg := fmt.Sprintf("/ack/%s/%d/", sessionID, app.SessionLen(sessionID))
-			send(l, ackMsg, remoteAddr)
-			continue
-		}
 
-		if msgClose.Match(buff[:n]) {
-			parts := msgClose.FindAllSubmatch(buff[:n], -1)[0]
-			sessionID := string(parts[1])
-			app.StopSession(sessionID)
-			closeMsg := fmt.Sprintf("/close/%s/", sessionID)
-			send(l, closeMsg, remoteAddr)
-			continue
-		}
+	lc := &lrcp.ListenConfig{
+		RetransmitTimeout: *retransmitTimeout,
+		SessionTimeout:    *sessionTimeout,
+		Metrics:           reg,
+	}
+	srv := serverConfig.Server(flag.Arg(0), server.HandlerFunc(reverseLines), reg)
+	srv.Listen = lc.Listen
 
-		if msgData.Match(buff[:n]) {
-			parts := msgData.FindAllSubmatch(buff[:n], -1)[0]
-			sessionID := string(parts[1])
-			pos, _ := strconv.Atoi(string(parts[2]))
-			data := parts[3]
-			if !bytes.HasSuffix(data, []byte("/")) {
-				log.Println("doesn't end in /, discard")
-				continue
-			}
-			data = data[:len(data)-1]
-			// /data/950833135/543/illegal data/has too many/parts/
-			if bytes.Count(data, []byte("/")) > bytes.Count(data, []byte(`\`)) {
-				log.Println("contains unescaped slashes")
-				continue
-			}
-			err := app.WriteTo(sessionID, pos, unescape(data))
-			if err != nil && err == ErrSessionNotConnected {
-				closeMsg := fmt.Sprintf("/close/%s/", sessionID)
-				send(l, closeMsg, remoteAddr)
-				continue
-			}
-			if err != nil {
-				fmt.Printf("Session %s. Write error: %s\n", sessionID, err.Error())
-			}
+	if err := srv.ListenAndServe(ctx); err != nil && err != server.ErrServerClosed {
+		slog.Error("server stopped", "err", err)
+		os.Exit(1)
+	}
+}
 
-			ackMsg := fmt.Sprintf("/ack/%s/%d/", sessionID, app.SessionLen(sessionID))
-			send(l, ackMsg, remoteAddr)
+// reverseLines sends back every line received, reversed.
+func reverseLines(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
 
-			continue
+	log := logging.FromContext(ctx)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if log.Enabled(ctx, slog.LevelDebug) {
+			log.LogAttrs(ctx, slog.LevelDebug, "line received", slog.String("line", string(line)))
 		}
-
-		if msgAck.Match(buff[:n]) {
-			parts := msgAck.FindAllSubmatch(buff[:n], -1)[0]
-			sessionID := string(parts[1])
-			length, _ := strconv.Atoi(string(parts[2]))
-			if !app.IsConnected(sessionID) {
-				closeMsg := fmt.Sprintf("/close/%s/", sessionID)
-				send(l, closeMsg, remoteAddr)
-				continue
-			}
-
-			app.AckFor(sessionID, length)
-
-			continue
+		if _, err := conn.Write(append(revert(line), '\n')); err != nil {
+			return
 		}
-
-		log.Println("message discarded")
-	}
-
-}
-
-func send(l net.PacketConn, msg string, remoteAddr net.Addr) {
-	log.Printf("%s <-- %s\n", remoteAddr.String(), msg)
-	if _, err := l.WriteTo([]byte(msg), remoteAddr); err != nil {
-		log.Println("Message not sent:", err)
 	}
 }
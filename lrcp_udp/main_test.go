@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mehix/protohackers/lrcp"
+	"github.com/mehix/protohackers/server"
+)
+
+func TestReverseLines(t *testing.T) {
+
+	l, err := lrcp.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &server.Server{Handler: server.HandlerFunc(reverseLines)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.Serve(ctx, l)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	exchange := func(packet string, expect ...string) {
+		t.Helper()
+		if _, err := pc.WriteTo([]byte(packet), l.Addr()); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1000)
+		for _, want := range expect {
+			pc.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(buf[:n]); got != want {
+				t.Fatalf("wrong packet. expected: %q, got: %q", want, got)
+			}
+		}
+	}
+
+	exchange("/connect/1/", "/ack/1/0/")
+	exchange("/data/1/0/hello\n/", "/ack/1/6/", "/data/1/0/olleh\n/")
+	exchange("/ack/1/6/")
+	exchange(`/data/1/6/a\/b\\/`, "/ack/1/10/")
+	exchange("/data/1/10/c\n/", "/ack/1/12/", `/data/1/6/c\\b\/a`+"\n/")
+}
+
+func TestRevert(t *testing.T) {
+
+	for in, out := range map[string]string{"": "", "hello": "olleh", "héllo": "olléh"} {
+		if got := string(revert([]byte(in))); got != out {
+			t.Fatalf("wrong reversal of %q. expected: %q, got: %q", in, out, got)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/mehix/protohackers/logging"
+	"github.com/mehix/protohackers/lrcp"
+	"github.com/mehix/protohackers/server"
+)
+
+var (
+	timeout    = flag.Duration("timeout", time.Minute, "time the server gets to acknowledge the connect")
+	ackTimeout = flag.Duration("ack-timeout", 10*time.Second, "time the server gets to acknowledge all of stdin once it is exhausted")
+	linger     = flag.Duration("linger", 3*time.Second, "time to wait for the replies once the server acknowledged all of stdin")
+	logConfig  = logging.Flags(flag.CommandLine)
+)
+
+// lrcpcat opens an LRCP session, sends stdin through it and prints what the
+// server sends back.
+func main() {
+	flag.Parse()
+	logConfig.Install()
+	if flag.NArg() < 1 {
+		fmt.Println("Usage: lrcpcat [flags] <addr>")
+		os.Exit(1)
+	}
+
+	ctx, stop := server.SignalContext()
+	defer stop()
+
+	d := &lrcp.Dialer{Timeout: *timeout}
+	conn, err := d.DialContext(ctx, flag.Arg(0))
+	if err != nil {
+		slog.Error("connecting", "err", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+	session := conn.(*lrcp.Conn)
+
+	received := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(os.Stdout, conn)
+		received <- err
+	}()
+
+	sent := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(conn, os.Stdin)
+		sent <- err
+	}()
+
+	// LRCP has no half close: once stdin is done, wait for the server to
+	// acknowledge all of it, then give it some time to answer before closing
+	// the session.
+	flushed := make(chan error, 1)
+	var lingering <-chan time.Time
+	for {
+		select {
+		case err := <-sent:
+			if err != nil {
+				slog.Error("sending", "err", err)
+				conn.Close()
+				os.Exit(1)
+			}
+			go func() {
+				fctx, cancel := context.WithTimeout(ctx, *ackTimeout)
+				defer cancel()
+				flushed <- session.Flush(fctx)
+			}()
+		case err := <-flushed:
+			if err != nil && ctx.Err() == nil {
+				slog.Error("waiting for the server to acknowledge stdin", "err", err)
+				conn.Close()
+				os.Exit(1)
+			}
+			lingering = time.After(*linger)
+		case err := <-received:
+			if err != nil {
+				slog.Error("receiving", "err", err)
+				conn.Close()
+				os.Exit(1)
+			}
+			return
+		case <-lingering:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -1,61 +1,84 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math"
 	"math/big"
 	"net"
 	"os"
 	"time"
+
+	"github.com/mehix/protohackers/clock"
+	"github.com/mehix/protohackers/logging"
+	"github.com/mehix/protohackers/metrics"
+	"github.com/mehix/protohackers/server"
+)
+
+var (
+	serverConfig = server.Flags(flag.CommandLine)
+	logConfig    = logging.Flags(flag.CommandLine)
 )
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: means <addr>")
+	flag.Parse()
+	logConfig.Install()
+	if flag.NArg() < 1 {
+		fmt.Println("Usage: means [flags] <addr>")
 		os.Exit(1)
 	}
 
-	addr := os.Args[1]
+	ctx, stop := server.SignalContext()
+	defer stop()
 
-	if err := startSrvr(addr); err != nil {
-		log.Println(err)
+	reg, err := serverConfig.Metrics(ctx)
+	if err != nil {
+		slog.Error("starting metrics endpoint", "err", err)
+		os.Exit(1)
 	}
-}
 
-func startSrvr(addr string) error {
-	l, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
+	h := handler{
+		clock:   clock.Real,
+		timeout: sessionTimeout,
+		inserts: reg.Counter("means_inserts_total", "Prices inserted."),
+		queries: reg.Counter("means_queries_total", "Mean price queries answered."),
 	}
-	defer l.Close()
+	srv := serverConfig.Server(flag.Arg(0), h, reg)
 
-	fmt.Printf("Listen on %s\n", addr)
+	if err := srv.ListenAndServe(ctx); err != nil && err != server.ErrServerClosed {
+		slog.Error("server stopped", "err", err)
+		os.Exit(1)
+	}
+}
 
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			return err
-		}
+// sessionTimeout is how long a client may stay connected.
+const sessionTimeout = 60 * time.Second
 
-		go handleConn(conn)
-	}
+// handler serves one client until it disconnects or timeout passed on
+// clock.
+type handler struct {
+	clock   clock.Clock
+	timeout time.Duration
+
+	inserts, queries *metrics.Counter
 }
 
-func handleConn(conn net.Conn) {
+func (h handler) ServeConn(ctx context.Context, conn net.Conn) {
 
-	defer func() func() {
-		fmt.Printf("Connection from %s\n", conn.RemoteAddr())
-		msg := fmt.Sprintf("Done with %s!", conn.RemoteAddr())
-		return func() {
-			fmt.Println(msg)
-			conn.Close()
-		}
-	}()()
+	defer conn.Close()
+
+	log := logging.FromContext(ctx)
 
-	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	expire := h.clock.AfterFunc(h.timeout, func() {
+		log.Debug("session timed out")
+		// any time in the past fails the pending read
+		conn.SetReadDeadline(time.Unix(1, 0))
+	})
+	defer expire.Stop()
 
 	prices := make(map[int32]int32)
 
@@ -71,19 +94,27 @@ func handleConn(conn net.Conn) {
 			timestamp := binary.BigEndian.Uint32(buf[1:5])
 			price := binary.BigEndian.Uint32(buf[5:])
 			prices[int32(timestamp)] = int32(price)
-			fmt.Printf("<-- %d %d\n", timestamp, price)
+			h.inserts.Inc()
+			if log.Enabled(ctx, slog.LevelDebug) {
+				log.LogAttrs(ctx, slog.LevelDebug, "insert", slog.Int64("timestamp", int64(int32(timestamp))), slog.Int64("price", int64(int32(price))))
+			}
 		case 'Q':
 			start := int32(binary.BigEndian.Uint32(buf[1:5]))
 			end := int32(binary.BigEndian.Uint32(buf[5:]))
 
-			writeMean(conn, start, end, prices)
+			mean := writeMean(conn, start, end, prices)
+			h.queries.Inc()
+			if log.Enabled(ctx, slog.LevelDebug) {
+				log.LogAttrs(ctx, slog.LevelDebug, "query", slog.Int64("start", int64(start)), slog.Int64("end", int64(end)), slog.Int64("mean", int64(mean)))
+			}
 		default:
-			log.Printf("unknown command: %x\n", buf[0])
+			log.Warn("unknown command", "type", fmt.Sprintf("0x%02x", buf[0]))
 		}
 	}
 }
 
-func writeMean(conn net.Conn, start, end int32, prices map[int32]int32) {
+// writeMean sends the mean price between start and end and returns it.
+func writeMean(conn net.Conn, start, end int32, prices map[int32]int32) int32 {
 	total := big.NewInt(0)
 	count := int32(0)
 	if start <= end {
@@ -98,6 +129,6 @@ func writeMean(conn net.Conn, start, end int32, prices map[int32]int32) {
 	if count > 0 {
 		mean = math.Floor(float64(total.Int64()) / float64(count))
 	}
-	fmt.Printf("--> %.0f\n", mean)
 	conn.Write(binary.BigEndian.AppendUint32([]byte{}, uint32(mean)))
+	return int32(mean)
 }
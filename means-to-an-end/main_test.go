@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mehix/protohackers/clock"
+)
+
+func message(kind byte, a, b int32) []byte {
+	msg := []byte{kind}
+	msg = binary.BigEndian.AppendUint32(msg, uint32(a))
+	return binary.BigEndian.AppendUint32(msg, uint32(b))
+}
+
+func query(t *testing.T, c net.Conn, start, end int32) int32 {
+	t.Helper()
+
+	c.Write(message('Q', start, end))
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	return int32(binary.BigEndian.Uint32(buf))
+}
+
+func TestSessionTimeout(t *testing.T) {
+
+	clk := clock.NewFake(time.Unix(0, 0))
+	h := handler{clock: clk, timeout: sessionTimeout}
+
+	client, srv := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeConn(context.Background(), srv)
+	}()
+
+	client.Write(message('I', 12345, 101))
+	client.Write(message('I', 12346, 102))
+	if mean := query(t, client, 12345, 12346); mean != 101 {
+		t.Fatalf("wrong mean. expected: 101, got: %d", mean)
+	}
+
+	clk.BlockUntil(1)
+	clk.Advance(sessionTimeout - time.Second)
+	if mean := query(t, client, 12345, 12345); mean != 101 {
+		t.Fatalf("wrong mean before the timeout. expected: 101, got: %d", mean)
+	}
+
+	clk.Advance(time.Second)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("connection still served after the timeout")
+	}
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got: %v", err)
+	}
+}
@@ -0,0 +1,318 @@
+// Package metrics keeps counters and gauges and exposes them in the
+// Prometheus text format. Methods on a nil *Counter, *Gauge or *CounterVec do
+// nothing, so code can count unconditionally and leave metrics disabled by
+// not creating them.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counter only goes up.
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc() { c.Add(1) }
+
+func (c *Counter) Add(n uint64) {
+	if c != nil {
+		c.v.Add(n)
+	}
+}
+
+func (c *Counter) Value() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.v.Load()
+}
+
+// Gauge goes up and down.
+type Gauge struct {
+	v atomic.Int64
+}
+
+func (g *Gauge) Inc() { g.Add(1) }
+func (g *Gauge) Dec() { g.Add(-1) }
+
+func (g *Gauge) Add(n int64) {
+	if g != nil {
+		g.v.Add(n)
+	}
+}
+
+func (g *Gauge) Set(n int64) {
+	if g != nil {
+		g.v.Store(n)
+	}
+}
+
+func (g *Gauge) Value() int64 {
+	if g == nil {
+		return 0
+	}
+	return g.v.Load()
+}
+
+// CounterVec is a family of counters told apart by the values of its labels.
+type CounterVec struct {
+	labels   []string
+	m        sync.RWMutex
+	counters map[string]*Counter // label values joined by labelSep
+}
+
+const labelSep = "\xff"
+
+// With returns the counter for the given label values, one per label.
+func (v *CounterVec) With(values ...string) *Counter {
+	if v == nil {
+		return nil
+	}
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %d label values for labels %v", len(values), v.labels))
+	}
+	key := strings.Join(values, labelSep)
+
+	v.m.RLock()
+	c, ok := v.counters[key]
+	v.m.RUnlock()
+	if ok {
+		return c
+	}
+
+	v.m.Lock()
+	defer v.m.Unlock()
+	if c, ok = v.counters[key]; !ok {
+		c = new(Counter)
+		v.counters[key] = c
+	}
+	return c
+}
+
+// kind is the TYPE of a metric in the text format.
+type kind string
+
+const (
+	kindCounter kind = "counter"
+	kindGauge   kind = "gauge"
+)
+
+// metric is one registered name.
+type metric struct {
+	kind   kind
+	help   string
+	value  any // *Counter, *Gauge, *CounterVec, func() uint64 or func() int64
+	series func() []sample
+}
+
+type sample struct {
+	labels string // {a="b"}, or empty
+	value  string
+}
+
+// Registry holds the metrics of one process.
+type Registry struct {
+	m       sync.Mutex
+	metrics map[string]*metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]*metric)}
+}
+
+// register adds a metric, or returns the one already registered under name
+// so independent parts of a program can share it. A func metric has nothing
+// to share, so it replaces the one registered before. It panics if name is
+// taken by a metric of another type.
+func (r *Registry) register(name string, m *metric) *metric {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if old, ok := r.metrics[name]; ok {
+		if fmt.Sprintf("%T", old.value) != fmt.Sprintf("%T", m.value) {
+			panic(fmt.Sprintf("metrics: %s registered twice with different types", name))
+		}
+		switch m.value.(type) {
+		case func() uint64, func() int64:
+		default:
+			return old
+		}
+	}
+	r.metrics[name] = m
+	return m
+}
+
+// Counter returns the counter called name, creating it if needed. A nil
+// Registry returns a nil Counter.
+func (r *Registry) Counter(name, help string) *Counter {
+	if r == nil {
+		return nil
+	}
+	c := new(Counter)
+	m := r.register(name, &metric{kind: kindCounter, help: help, value: c, series: func() []sample {
+		return []sample{{value: strconv.FormatUint(c.Value(), 10)}}
+	}})
+	return m.value.(*Counter)
+}
+
+// Gauge returns the gauge called name, creating it if needed. A nil Registry
+// returns a nil Gauge.
+func (r *Registry) Gauge(name, help string) *Gauge {
+	if r == nil {
+		return nil
+	}
+	g := new(Gauge)
+	m := r.register(name, &metric{kind: kindGauge, help: help, value: g, series: func() []sample {
+		return []sample{{value: strconv.FormatInt(g.Value(), 10)}}
+	}})
+	return m.value.(*Gauge)
+}
+
+// GaugeFunc registers a gauge whose value is read from f at every scrape.
+// f must be safe to call from any goroutine. Registering name again replaces
+// f, so the latest registration is scraped.
+func (r *Registry) GaugeFunc(name, help string, f func() int64) {
+	if r == nil {
+		return
+	}
+	r.register(name, &metric{kind: kindGauge, help: help, value: f, series: func() []sample {
+		return []sample{{value: strconv.FormatInt(f(), 10)}}
+	}})
+}
+
+// CounterFunc registers a counter whose value is read from f at every
+// scrape, for counts the program keeps anyway. f must be safe to call from
+// any goroutine. Registering name again replaces f.
+func (r *Registry) CounterFunc(name, help string, f func() uint64) {
+	if r == nil {
+		return
+	}
+	r.register(name, &metric{kind: kindCounter, help: help, value: f, series: func() []sample {
+		return []sample{{value: strconv.FormatUint(f(), 10)}}
+	}})
+}
+
+// CounterVec returns the counters called name with the given labels,
+// creating them if needed. A nil Registry returns a nil CounterVec.
+func (r *Registry) CounterVec(name, help string, labels ...string) *CounterVec {
+	if r == nil {
+		return nil
+	}
+	v := &CounterVec{labels: labels, counters: make(map[string]*Counter)}
+	m := r.register(name, &metric{kind: kindCounter, help: help, value: v, series: func() []sample {
+		v.m.RLock()
+		defer v.m.RUnlock()
+
+		samples := make([]sample, 0, len(v.counters))
+		for key, c := range v.counters {
+			samples = append(samples, sample{labels: formatLabels(v.labels, strings.Split(key, labelSep)), value: strconv.FormatUint(c.Value(), 10)})
+		}
+		sort.Slice(samples, func(i, j int) bool { return samples[i].labels < samples[j].labels })
+		return samples
+	}})
+	return m.value.(*CounterVec)
+}
+
+func formatLabels(names, values []string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+// WriteTo writes every metric in the text format, ordered by name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.m.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	metrics := make(map[string]*metric, len(r.metrics))
+	for name, m := range r.metrics {
+		metrics[name] = m
+	}
+	r.m.Unlock()
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		m := metrics[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, helpEscaper.Replace(m.help), name, m.kind)
+		for _, s := range m.series() {
+			fmt.Fprintf(&b, "%s%s %s\n", name, s.labels, s.value)
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP answers scrapes.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// Listen returns a new Registry served on /metrics at addr until ctx is
+// cancelled. It returns once the endpoint listens; later failures are
+// logged. An empty addr disables metrics and returns a nil Registry.
+func Listen(ctx context.Context, addr string) (*Registry, error) {
+	if addr == "" {
+		return nil, nil
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	r := NewRegistry()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		slog.Info("metrics listening", "addr", l.Addr().String())
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			slog.Error("metrics stopped", "err", err)
+		}
+	}()
+
+	return r, nil
+}
@@ -0,0 +1,164 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+
+	r := NewRegistry()
+	r.Counter("requests_total", "Requests served.").Add(3)
+	g := r.Gauge("connections_active", "Open connections.")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	r.GaugeFunc("users", "Users in the room.", func() int64 { return 7 })
+	r.CounterFunc("evicted_total", "Evictions.", func() uint64 { return 4 })
+	v := r.CounterVec("messages_total", "Messages by type.", "direction", "type")
+	v.With("in", "Plate").Add(2)
+	v.With("out", `say "hi"`).Inc()
+	v.With("in", "IAmCamera").Inc()
+
+	var b strings.Builder
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP connections_active Open connections.
+# TYPE connections_active gauge
+connections_active 1
+# HELP evicted_total Evictions.
+# TYPE evicted_total counter
+evicted_total 4
+# HELP messages_total Messages by type.
+# TYPE messages_total counter
+messages_total{direction="in",type="IAmCamera"} 1
+messages_total{direction="in",type="Plate"} 2
+messages_total{direction="out",type="say \"hi\""} 1
+# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total 3
+# HELP users Users in the room.
+# TYPE users gauge
+users 7
+`
+	if b.String() != expected {
+		t.Fatalf("wrong output.\nexpected:\n%s\ngot:\n%s", expected, b.String())
+	}
+}
+
+func TestSharedRegistration(t *testing.T) {
+
+	r := NewRegistry()
+	r.Counter("bytes_total", "Bytes.").Inc()
+	r.Counter("bytes_total", "Bytes.").Inc()
+
+	if n := r.Counter("bytes_total", "Bytes.").Value(); n != 2 {
+		t.Fatalf("expected both users to share the counter, got %d", n)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering a name with another type should panic")
+		}
+	}()
+	r.Gauge("bytes_total", "Bytes.")
+}
+
+func TestFuncReplacedWhenRegisteredAgain(t *testing.T) {
+
+	r := NewRegistry()
+	r.GaugeFunc("sessions", "Sessions.", func() int64 { return 1 })
+	r.GaugeFunc("sessions", "Sessions.", func() int64 { return 2 })
+	r.CounterFunc("drops_total", "Drops.", func() uint64 { return 3 })
+	r.CounterFunc("drops_total", "Drops.", func() uint64 { return 4 })
+
+	var b strings.Builder
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"sessions 2\n", "drops_total 4\n"} {
+		if !strings.Contains(b.String(), line) {
+			t.Fatalf("latest registration not scraped, expected %q in:\n%s", line, b.String())
+		}
+	}
+}
+
+func TestNilIsDisabled(t *testing.T) {
+
+	var r *Registry
+	c := r.Counter("a", "")
+	g := r.Gauge("b", "")
+	v := r.CounterVec("c", "", "l")
+	r.GaugeFunc("d", "", func() int64 { return 1 })
+	r.CounterFunc("e", "", func() uint64 { return 1 })
+
+	c.Inc()
+	g.Set(3)
+	v.With("x").Inc()
+
+	if c.Value() != 0 || g.Value() != 0 {
+		t.Fatal("nil metrics should read as zero")
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+
+	r := NewRegistry()
+	r.Counter("hits_total", "Hits.").Inc()
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("wrong content type: %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "hits_total 1\n") {
+		t.Fatalf("missing sample in %q", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405 for POST, got %d", rec.Code)
+	}
+}
+
+func TestListen(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if r, err := Listen(ctx, ""); r != nil || err != nil {
+		t.Fatalf("expected metrics disabled without an address, got %v, %v", r, err)
+	}
+
+	// find a free port first, Listen returns before the endpoint is known
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	r, err := Listen(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Counter("hits_total", "Hits.").Inc()
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "hits_total 1\n") {
+		t.Fatalf("missing sample in %q", body)
+	}
+}
@@ -2,44 +2,54 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/big"
 	"net"
 	"os"
 	"strings"
+
+	"github.com/mehix/protohackers/logging"
+	"github.com/mehix/protohackers/lrcp"
+	"github.com/mehix/protohackers/metrics"
+	"github.com/mehix/protohackers/server"
+)
+
+var (
+	overLRCP     = flag.Bool("lrcp", false, "serve over LRCP on UDP instead of TCP")
+	serverConfig = server.Flags(flag.CommandLine)
+	logConfig    = logging.Flags(flag.CommandLine)
 )
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: primetime <addr>")
+	flag.Parse()
+	logConfig.Install()
+	if flag.NArg() < 1 {
+		fmt.Println("Usage: primetime [flags] <addr>")
 		os.Exit(1)
 	}
 
-	addr := os.Args[1]
+	ctx, stop := server.SignalContext()
+	defer stop()
 
-	if err := startSrvr(addr); err != nil {
-		log.Println(err)
-	}
-}
-
-func startSrvr(addr string) error {
-	l, err := net.Listen("tcp", addr)
+	reg, err := serverConfig.Metrics(ctx)
 	if err != nil {
-		return err
+		slog.Error("starting metrics endpoint", "err", err)
+		os.Exit(1)
 	}
-	defer l.Close()
 
-	fmt.Printf("Listen on %s\n", addr)
+	srv := serverConfig.Server(flag.Arg(0), newHandler(reg), reg)
 
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			return err
-		}
+	if *overLRCP {
+		srv.Listen = (&lrcp.ListenConfig{Metrics: reg}).Listen
+	}
 
-		go handleConn(conn)
+	if err := srv.ListenAndServe(ctx); err != nil && err != server.ErrServerClosed {
+		slog.Error("server stopped", "err", err)
+		os.Exit(1)
 	}
 }
 
@@ -74,15 +84,33 @@ type Response struct {
 	IsPrime bool   `json:"prime"`
 }
 
-func handleConn(conn net.Conn) {
+// handler answers the requests of one client at a time.
+type handler struct {
+	requests  *metrics.Counter
+	malformed *metrics.Counter
+}
+
+func newHandler(r *metrics.Registry) handler {
+	return handler{
+		requests:  r.Counter("primetime_requests_total", "Requests received."),
+		malformed: r.Counter("primetime_malformed_requests_total", "Requests answered with an error."),
+	}
+}
+
+func (h handler) ServeConn(ctx context.Context, conn net.Conn) {
 
 	defer conn.Close()
 
+	log := logging.FromContext(ctx)
+
 	scnr := bufio.NewScanner(conn)
 
 	for scnr.Scan() {
+		h.requests.Inc()
 		resp, err := process(scnr.Text())
 		if err != nil {
+			h.malformed.Inc()
+			log.Debug("malformed request", "err", err)
 			conn.Write([]byte(err.Error() + "\n"))
 			continue
 		}
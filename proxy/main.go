@@ -3,64 +3,83 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"regexp"
 	"strings"
+
+	"github.com/mehix/protohackers/logging"
+	"github.com/mehix/protohackers/metrics"
+	"github.com/mehix/protohackers/server"
+)
+
+var (
+	serverConfig = server.Flags(flag.CommandLine)
+	logConfig    = logging.Flags(flag.CommandLine)
 )
 
 func main() {
-	if len(os.Args) < 3 {
-		fmt.Println("Usage: proxy <addr> <remote:port>")
+	flag.Parse()
+	logConfig.Install()
+	if flag.NArg() < 2 {
+		fmt.Println("Usage: proxy [flags] <addr> <remote:port>")
 		os.Exit(1)
 	}
 
-	if err := startProxy(os.Args[1], os.Args[2]); err != nil {
-		log.Fatal(err)
-	}
-}
-
-func startProxy(localAddr, remoteAddr string) error {
+	ctx, stop := server.SignalContext()
+	defer stop()
 
-	// connect local
-	l, err := net.Listen("tcp", localAddr)
+	reg, err := serverConfig.Metrics(ctx)
 	if err != nil {
-		return err
+		slog.Error("starting metrics endpoint", "err", err)
+		os.Exit(1)
 	}
-	defer l.Close()
 
-	for {
-		lc, err := l.Accept()
-		if err != nil {
-			return err
-		}
+	r := &relay{
+		remote:   flag.Arg(1),
+		lines:    reg.Counter("proxy_lines_total", "Lines relayed in either direction."),
+		rewrites: reg.Counter("proxy_rewrites_total", "Boguscoin addresses replaced."),
+	}
+	srv := serverConfig.Server(flag.Arg(0), r, reg)
 
-		// bind
-		go handleConn(lc, remoteAddr)
+	if err := srv.ListenAndServe(ctx); err != nil && err != server.ErrServerClosed {
+		slog.Error("server stopped", "err", err)
+		os.Exit(1)
 	}
+}
 
+// relay connects every client to the remote server and rewrites the lines
+// they exchange.
+type relay struct {
+	remote   string
+	lines    *metrics.Counter
+	rewrites *metrics.Counter
 }
 
-func handleConn(local net.Conn, remoteAddr string) {
+func (r *relay) ServeConn(ctx context.Context, local net.Conn) {
 	defer local.Close()
 
+	log := logging.FromContext(ctx)
+
 	// connect remote
-	rc, err := net.Dial("tcp", remoteAddr)
+	rc, err := net.Dial("tcp", r.remote)
 	if err != nil {
-		log.Println("no conn to remote", err)
+		log.Error("no conn to remote", "upstream", r.remote, "err", err)
 		return
 	}
 	defer rc.Close()
 
 	go func() {
 		defer local.Close()
-		hijack(local, rc)
+		r.hijack(ctx, log.With("direction", "downstream"), local, rc)
 	}()
 
-	hijack(rc, local)
+	r.hijack(ctx, log.With("direction", "upstream"), rc, local)
 }
 
 var pattern = regexp.MustCompile(`^7[0-9a-zA-Z]{25,34}$`)
@@ -69,7 +88,7 @@ const (
 	coinAddr = `7YWHMfk9JZe0LM0g1ZauHuiSxhI`
 )
 
-func hijack(dest, src io.ReadWriter) {
+func (r *relay) hijack(ctx context.Context, log *slog.Logger, dest, src io.ReadWriter) {
 
 	dropCR := func(data []byte) []byte {
 		if len(data) > 0 && data[len(data)-1] == '\r' {
@@ -99,30 +118,34 @@ func hijack(dest, src io.ReadWriter) {
 	scnr.Split(splitFullLines)
 	for scnr.Scan() {
 		orig := scnr.Text()
-		txt := replaceCoinAddr(orig)
+		txt, replaced := replaceCoinAddr(orig)
+		r.lines.Inc()
+		r.rewrites.Add(uint64(replaced))
 
-		fmt.Printf("'%s' >> '%s'\n", orig, txt)
+		if log.Enabled(ctx, slog.LevelDebug) {
+			log.LogAttrs(ctx, slog.LevelDebug, "line", slog.String("orig", orig), slog.String("sent", txt))
+		}
 		if _, err := fmt.Fprintln(dest, txt); err != nil {
-			log.Println("remote read error", err)
+			log.Info("write error", "err", err)
 			return
 		}
 
 	}
 }
 
-func replaceCoinAddr(str string) string {
-	//fmt.Printf("R: '%s'\n", str)
+// replaceCoinAddr returns str with every Boguscoin address replaced, and how
+// many were replaced.
+func replaceCoinAddr(str string) (string, int) {
+	replaced := 0
 	parts := strings.Split(str, " ")
 	for i := range parts {
-		//fmt.Printf("T: '%s'\n", parts[i])
 		if pattern.MatchString(strings.TrimSpace(parts[i])) {
-			//fmt.Printf("F: '%s'\n", parts[i])
 			parts[i] = coinAddr
+			replaced++
 		}
 	}
 
 	resp := strings.Join(parts, " ")
-	//fmt.Printf("'%s'\n", resp)
 
-	return resp
+	return resp, replaced
 }
@@ -3,7 +3,12 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"log/slog"
+	"strings"
 	"testing"
+
+	"github.com/mehix/protohackers/metrics"
 )
 
 func TestReplaceCoinAddress(t *testing.T) {
@@ -37,10 +42,28 @@ func TestReplaceCoinAddress(t *testing.T) {
 			t.Parallel()
 			src := bufio.NewReadWriter(bufio.NewReader(bytes.NewReader([]byte(s.in))), nil)
 			var dst bytes.Buffer
-			hijack(&dst, src)
+			(&relay{}).hijack(context.Background(), slog.Default(), &dst, src)
 			if dst.String() != s.out {
 				t.Fatalf("wrong output.\nexpected:\n%s\ngot:\n%s", s.out, dst.String())
 			}
 		})
 	}
 }
+
+func TestRewritesCounted(t *testing.T) {
+
+	reg := metrics.NewRegistry()
+	r := &relay{lines: reg.Counter("lines", ""), rewrites: reg.Counter("rewrites", "")}
+
+	in := "pay 7F1u3wSD5RbOHQmupo9nx4TnhQ please\nno address here\n7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX 7LOrwbDlS8NujgjddyogWgIM93MV5N2VR\n"
+	src := bufio.NewReadWriter(bufio.NewReader(strings.NewReader(in)), nil)
+	var dst bytes.Buffer
+	r.hijack(context.Background(), slog.Default(), &dst, src)
+
+	if n := r.lines.Value(); n != 3 {
+		t.Fatalf("expected 3 lines, got %d", n)
+	}
+	if n := r.rewrites.Value(); n != 3 {
+		t.Fatalf("expected 3 rewrites, got %d", n)
+	}
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	"github.com/mehix/protohackers/metrics"
+)
+
+// Config is the server setup chosen on the command line.
+type Config struct {
+	MaxConns        int
+	ShutdownTimeout time.Duration
+	MetricsAddr     string // address of the metrics endpoint, empty disables it
+}
+
+// Flags registers -max-conns, -shutdown-timeout and -metrics on fs.
+func Flags(fs *flag.FlagSet) *Config {
+	c := &Config{}
+	fs.IntVar(&c.MaxConns, "max-conns", 0, "maximum number of concurrent connections (0 means no limit)")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", 5*time.Second, "time given to active connections to finish on shutdown")
+	fs.StringVar(&c.MetricsAddr, "metrics", "", "address of the Prometheus metrics endpoint (empty disables it)")
+	return c
+}
+
+// Metrics starts the metrics endpoint until ctx is cancelled. It returns a
+// nil Registry when the endpoint is disabled.
+func (c *Config) Metrics(ctx context.Context) (*metrics.Registry, error) {
+	return metrics.Listen(ctx, c.MetricsAddr)
+}
+
+// Server returns a Server for h on addr with the chosen limits, counting in
+// reg.
+func (c *Config) Server(addr string, h Handler, reg *metrics.Registry) *Server {
+	return &Server{
+		Addr:            addr,
+		Handler:         h,
+		MaxConns:        c.MaxConns,
+		ShutdownTimeout: c.ShutdownTimeout,
+		Metrics:         reg,
+	}
+}
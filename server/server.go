@@ -0,0 +1,269 @@
+// Package server implements the TCP accept loop shared by the protohackers
+// binaries. Each connection is served on its own goroutine by a Handler.
+// Cancelling the context passed to Serve stops accepting new connections and
+// drains the active ones.
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/mehix/protohackers/clock"
+	"github.com/mehix/protohackers/logging"
+	"github.com/mehix/protohackers/metrics"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after the context
+// they were started with is cancelled.
+var ErrServerClosed = errors.New("server closed")
+
+// Handler serves a single connection. ctx is cancelled when the server shuts
+// down and carries a logger for the connection, see logging.FromContext. The
+// connection is closed by the server once ServeConn returns.
+type Handler interface {
+	ServeConn(ctx context.Context, conn net.Conn)
+}
+
+// HandlerFunc adapts an ordinary function to the Handler interface.
+type HandlerFunc func(ctx context.Context, conn net.Conn)
+
+func (f HandlerFunc) ServeConn(ctx context.Context, conn net.Conn) {
+	f(ctx, conn)
+}
+
+type Server struct {
+	Addr    string
+	Handler Handler
+
+	// Listen opens the listener of ListenAndServe. Nil listens on TCP.
+	Listen func(addr string) (net.Listener, error)
+
+	// MaxConns limits how many connections are served at the same time.
+	// When the limit is reached new connections wait in the listen backlog.
+	// Zero means no limit.
+	MaxConns int
+
+	// ShutdownTimeout is how long active connections get to finish after
+	// shutdown starts before they are closed. Zero waits until every
+	// handler has returned.
+	ShutdownTimeout time.Duration
+
+	// Clock times the shutdown. Nil means the real clock.
+	Clock clock.Clock
+
+	// Logger logs the server and, with the remote address added, each
+	// connection. Nil means slog.Default().
+	Logger *slog.Logger
+
+	// Metrics receives the connection and byte counts. Nil disables them.
+	Metrics *metrics.Registry
+
+	m     sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+	stats connStats
+}
+
+// connStats are the counters kept in Metrics.
+type connStats struct {
+	active   *metrics.Gauge
+	accepted *metrics.Counter
+	panics   *metrics.Counter
+	in, out  *metrics.Counter
+}
+
+func newConnStats(r *metrics.Registry) connStats {
+	return connStats{
+		active:   r.Gauge("connections_active", "Connections being served."),
+		accepted: r.Counter("connections_total", "Connections accepted."),
+		panics:   r.Counter("connection_panics_total", "Handlers that panicked."),
+		in:       r.Counter("bytes_received_total", "Bytes read from clients."),
+		out:      r.Counter("bytes_sent_total", "Bytes written to clients."),
+	}
+}
+
+// countingConn counts the bytes read from and written to a connection.
+type countingConn struct {
+	net.Conn
+	in, out *metrics.Counter
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.in.Add(uint64(n))
+	return n, err
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.out.Add(uint64(n))
+	return n, err
+}
+
+// ListenAndServe listens on s.Addr and calls Serve.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	listen := s.Listen
+	if listen == nil {
+		listen = func(addr string) (net.Listener, error) {
+			return net.Listen("tcp", addr)
+		}
+	}
+	l, err := listen(s.Addr)
+	if err != nil {
+		return err
+	}
+
+	s.logger().Info("listening", "addr", l.Addr().String())
+
+	return s.Serve(ctx, l)
+}
+
+// Serve accepts connections on l until ctx is cancelled or Accept fails.
+// Before returning it stops accepting, interrupts blocked reads on the active
+// connections so their handlers can finish the message they are working on,
+// and waits for the handlers to return.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Close()
+		case <-done:
+		}
+	}()
+
+	s.stats = newConnStats(s.Metrics)
+
+	var slots chan struct{}
+	if s.MaxConns > 0 {
+		slots = make(chan struct{}, s.MaxConns)
+	}
+
+	var err error
+	for {
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+			}
+		}
+
+		conn, aerr := l.Accept()
+		if aerr != nil {
+			err = aerr
+			if ctx.Err() != nil {
+				err = ErrServerClosed
+			}
+			break
+		}
+
+		if s.Metrics != nil {
+			conn = countingConn{Conn: conn, in: s.stats.in, out: s.stats.out}
+		}
+		s.stats.accepted.Inc()
+		s.track(conn)
+		s.wg.Add(1)
+		go s.serveConn(ctx, conn, slots)
+	}
+
+	l.Close()
+	cancel()
+	s.drain()
+
+	return err
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger == nil {
+		return slog.Default()
+	}
+	return s.Logger
+}
+
+func (s *Server) serveConn(ctx context.Context, conn net.Conn, slots chan struct{}) {
+	log := s.logger().With("remote", conn.RemoteAddr().String())
+	log.Debug("connection accepted")
+	s.stats.active.Inc()
+
+	defer func() {
+		if r := recover(); r != nil {
+			s.stats.panics.Inc()
+			log.Error("panic serving connection", "panic", r, "stack", string(debug.Stack()))
+		}
+		s.stats.active.Dec()
+		log.Debug("connection closed")
+		conn.Close()
+		s.untrack(conn)
+		if slots != nil {
+			<-slots
+		}
+		s.wg.Done()
+	}()
+
+	s.Handler.ServeConn(logging.NewContext(ctx, log), conn)
+}
+
+func (s *Server) track(conn net.Conn) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	delete(s.conns, conn)
+}
+
+// drain waits for the active handlers to return. Blocked reads are
+// interrupted right away; connections still open after ShutdownTimeout are
+// closed.
+func (s *Server) drain() {
+	s.m.Lock()
+	for c := range s.conns {
+		c.SetReadDeadline(time.Now())
+	}
+	s.m.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(finished)
+	}()
+
+	var timeout <-chan time.Time
+	if s.ShutdownTimeout > 0 {
+		t := clock.Or(s.Clock).NewTimer(s.ShutdownTimeout)
+		defer t.Stop()
+		timeout = t.C()
+	}
+
+	select {
+	case <-finished:
+		return
+	case <-timeout:
+	}
+
+	s.m.Lock()
+	s.logger().Warn("shutdown timeout, closing connections", "conns", len(s.conns))
+	for c := range s.conns {
+		c.Close()
+	}
+	s.m.Unlock()
+
+	<-finished
+}
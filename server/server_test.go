@@ -0,0 +1,401 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mehix/protohackers/logging"
+	"github.com/mehix/protohackers/metrics"
+)
+
+func startServer(t *testing.T, srv *Server) (string, context.CancelFunc, chan error) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Serve(ctx, l)
+	}()
+
+	return l.Addr().String(), cancel, errs
+}
+
+func TestServeEcho(t *testing.T) {
+
+	srv := &Server{Handler: HandlerFunc(func(_ context.Context, conn net.Conn) {
+		io.Copy(conn, conn)
+	})}
+
+	addr, cancel, errs := startServer(t, srv)
+	defer cancel()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	fmt.Fprintln(c, "hello")
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "hello\n" {
+		t.Fatalf("wrong echo. expected: %q, got: %q", "hello\n", line)
+	}
+
+	cancel()
+	if err := <-errs; err != ErrServerClosed {
+		t.Fatalf("wrong error. expected: %v, got: %v", ErrServerClosed, err)
+	}
+}
+
+func TestShutdownDrainsConnections(t *testing.T) {
+
+	// the handler answers the line it is reading even if shutdown starts meanwhile
+	srv := &Server{Handler: HandlerFunc(func(ctx context.Context, conn net.Conn) {
+		scnr := bufio.NewScanner(conn)
+		for scnr.Scan() {
+			time.Sleep(100 * time.Millisecond)
+			fmt.Fprintln(conn, "ok", scnr.Text())
+		}
+		if ctx.Err() != nil {
+			fmt.Fprintln(conn, "bye")
+		}
+	})}
+
+	addr, cancel, errs := startServer(t, srv)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	fmt.Fprintln(c, "1")
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	rdr := bufio.NewReader(c)
+	for _, expect := range []string{"ok 1\n", "bye\n"} {
+		line, err := rdr.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != expect {
+			t.Fatalf("wrong line. expected: %q, got: %q", expect, line)
+		}
+	}
+
+	if _, err := rdr.ReadString('\n'); err != io.EOF {
+		t.Fatalf("connection should be closed, got: %v", err)
+	}
+
+	<-errs
+}
+
+func TestShutdownTimeoutClosesConnections(t *testing.T) {
+
+	// the handler never returns on its own
+	srv := &Server{
+		ShutdownTimeout: 50 * time.Millisecond,
+		Handler: HandlerFunc(func(_ context.Context, conn net.Conn) {
+			buf := make([]byte, 1)
+			for {
+				if _, err := conn.Read(buf); err != nil {
+					if ne, ok := err.(net.Error); ok && ne.Timeout() {
+						conn.SetReadDeadline(time.Time{})
+						continue
+					}
+					return
+				}
+			}
+		}),
+	}
+
+	addr, cancel, errs := startServer(t, srv)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Fatal("server did not stop after the shutdown timeout")
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+
+	var active, peak int32
+	srv := &Server{
+		MaxConns: 2,
+		Handler: HandlerFunc(func(_ context.Context, conn net.Conn) {
+			n := atomic.AddInt32(&active, 1)
+			defer atomic.AddInt32(&active, -1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+			fmt.Fprintln(conn, "done")
+		}),
+	}
+
+	addr, cancel, errs := startServer(t, srv)
+	defer func() {
+		cancel()
+		<-errs
+	}()
+
+	results := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				results <- err
+				return
+			}
+			defer c.Close()
+			_, err = bufio.NewReader(c).ReadString('\n')
+			results <- err
+		}()
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := <-results; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if p := atomic.LoadInt32(&peak); p > 2 {
+		t.Fatalf("too many connections served at once. expected at most 2, got: %d", p)
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+
+	srv := &Server{Handler: HandlerFunc(func(_ context.Context, conn net.Conn) {
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		if line == "panic\n" {
+			panic("handler failed")
+		}
+		fmt.Fprint(conn, line)
+	})}
+
+	addr, cancel, errs := startServer(t, srv)
+	defer func() {
+		cancel()
+		<-errs
+	}()
+
+	c1, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	fmt.Fprintln(c1, "panic")
+	if _, err := bufio.NewReader(c1).ReadString('\n'); err != io.EOF {
+		t.Fatalf("panicking connection should be closed, got: %v", err)
+	}
+
+	c2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	fmt.Fprintln(c2, "still alive")
+	line, err := bufio.NewReader(c2).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "still alive\n" {
+		t.Fatalf("wrong echo. expected: %q, got: %q", "still alive\n", line)
+	}
+}
+
+func TestConnectionLogger(t *testing.T) {
+
+	var buf syncBuffer
+	srv := &Server{
+		Logger: slog.New(slog.NewTextHandler(&buf, nil)),
+		Handler: HandlerFunc(func(ctx context.Context, conn net.Conn) {
+			logging.FromContext(ctx).Info("hello")
+			fmt.Fprintln(conn, "done")
+		}),
+	}
+
+	addr, cancel, errs := startServer(t, srv)
+	defer func() {
+		cancel()
+		<-errs
+	}()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := bufio.NewReader(c).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	want := fmt.Sprintf("msg=hello remote=%s", c.LocalAddr())
+	if out := buf.String(); !strings.Contains(out, want) {
+		t.Fatalf("expected %q in the log, got: %q", want, out)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	m   sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.buf.String()
+}
+
+func TestMetrics(t *testing.T) {
+
+	reg := metrics.NewRegistry()
+	srv := &Server{
+		Metrics: reg,
+		Handler: HandlerFunc(func(_ context.Context, conn net.Conn) {
+			io.Copy(conn, conn)
+		}),
+	}
+
+	addr, cancel, errs := startServer(t, srv)
+	defer func() {
+		cancel()
+		<-errs
+	}()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(c, "hello")
+	if _, err := bufio.NewReader(c).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := reg.Gauge("connections_active", "").Value(); n != 1 {
+		t.Fatalf("expected 1 active connection, got %d", n)
+	}
+	if n := reg.Counter("bytes_received_total", "").Value(); n != 6 {
+		t.Fatalf("expected 6 bytes received, got %d", n)
+	}
+	if n := reg.Counter("bytes_sent_total", "").Value(); n != 6 {
+		t.Fatalf("expected 6 bytes sent, got %d", n)
+	}
+
+	c.Close()
+	deadline := time.Now().Add(time.Second)
+	for reg.Gauge("connections_active", "").Value() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("closed connection still counted as active")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := reg.Counter("connections_total", "").Value(); n != 1 {
+		t.Fatalf("expected 1 accepted connection, got %d", n)
+	}
+}
+
+func TestListenAndServeUsesListen(t *testing.T) {
+
+	listening := make(chan net.Listener, 1)
+	srv := &Server{
+		Addr: "127.0.0.1:0",
+		Handler: HandlerFunc(func(_ context.Context, conn net.Conn) {
+			io.Copy(conn, conn)
+		}),
+		Listen: func(addr string) (net.Listener, error) {
+			l, err := net.Listen("tcp", addr)
+			if err == nil {
+				listening <- l
+			}
+			return l, err
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- srv.ListenAndServe(ctx) }()
+
+	var l net.Listener
+	select {
+	case l = <-listening:
+	case err := <-errs:
+		t.Fatal(err)
+	}
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprintln(c, "hello")
+	if line, err := bufio.NewReader(c).ReadString('\n'); err != nil || line != "hello\n" {
+		t.Fatalf("wrong echo. expected: %q, got: %q (%v)", "hello\n", line, err)
+	}
+
+	cancel()
+	if err := <-errs; err != ErrServerClosed {
+		t.Fatalf("wrong error. expected: %v, got: %v", ErrServerClosed, err)
+	}
+}
+
+func TestFlags(t *testing.T) {
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c := Flags(fs)
+	if err := fs.Parse([]string{"-max-conns", "3", "-shutdown-timeout", "2s"}); err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := c.Metrics(context.Background())
+	if err != nil || reg != nil {
+		t.Fatalf("metrics endpoint should be disabled by default, got: %v, %v", reg, err)
+	}
+
+	h := HandlerFunc(func(context.Context, net.Conn) {})
+	srv := c.Server("127.0.0.1:0", h, reg)
+	if srv.Addr != "127.0.0.1:0" || srv.MaxConns != 3 || srv.ShutdownTimeout != 2*time.Second {
+		t.Fatalf("server not configured from the flags: %+v", srv)
+	}
+}
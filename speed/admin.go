@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// The admin API serves read-only JSON views of the service. Every view copies
+// the state it needs under the read lock and encodes it after releasing the
+// lock, so a slow HTTP client never delays cameras or dispatchers.
+
+type DispatcherInfo struct {
+	Roads []uint16 `json:"roads"`
+	outboxStats
+}
+
+type TicketsInfo struct {
+	Pending   []Ticket `json:"pending"`
+	Delivered []Ticket `json:"delivered"`
+	Failed    []Ticket `json:"failed"`
+}
+
+// Cameras returns the connected cameras, ordered by road and mile.
+func (s *service) Cameras() []Camera {
+	s.camerasMutex.RLock()
+	cameras := make([]Camera, 0, len(s.cameras))
+	for c := range s.cameras {
+		cameras = append(cameras, *c)
+	}
+	s.camerasMutex.RUnlock()
+
+	sort.Slice(cameras, func(i, j int) bool {
+		if cameras[i].Road != cameras[j].Road {
+			return cameras[i].Road < cameras[j].Road
+		}
+		return cameras[i].Mile < cameras[j].Mile
+	})
+
+	return cameras
+}
+
+// Dispatchers returns the connected dispatchers with the state of their
+// queues.
+func (s *service) Dispatchers() []DispatcherInfo {
+	s.dispatcherMutex.RLock()
+	seen := make(map[*Dispatcher]struct{})
+	list := make([]*Dispatcher, 0)
+	for _, ds := range s.dispatchers {
+		for _, d := range ds {
+			if _, ok := seen[d]; !ok {
+				seen[d] = struct{}{}
+				list = append(list, d)
+			}
+		}
+	}
+	s.dispatcherMutex.RUnlock()
+
+	infos := make([]DispatcherInfo, 0, len(list))
+	for _, d := range list {
+		infos = append(infos, DispatcherInfo{Roads: slices.Clone(d.Roads), outboxStats: d.out.Stats()})
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return slices.Compare(infos[i].Roads, infos[j].Roads) < 0
+	})
+
+	return infos
+}
+
+// Tickets returns the tickets waiting for a dispatcher, those already
+// delivered and those given up.
+func (s *service) Tickets() TicketsInfo {
+	s.ticketsMutex.RLock()
+	defer s.ticketsMutex.RUnlock()
+
+	info := TicketsInfo{
+		Pending:   make([]Ticket, 0),
+		Delivered: slices.Clone(s.delivered),
+		Failed:    slices.Clone(s.failed),
+	}
+	for _, tickets := range s.pending {
+		info.Pending = append(info.Pending, tickets...)
+	}
+	if info.Delivered == nil {
+		info.Delivered = make([]Ticket, 0)
+	}
+	if info.Failed == nil {
+		info.Failed = make([]Ticket, 0)
+	}
+
+	sort.Slice(info.Pending, func(i, j int) bool {
+		if info.Pending[i].Road != info.Pending[j].Road {
+			return info.Pending[i].Road < info.Pending[j].Road
+		}
+		return info.Pending[i].Timestamp1 < info.Pending[j].Timestamp1
+	})
+
+	return info
+}
+
+// Observations returns every reading of a plate, ordered by road and time.
+// Only the readings of that plate are copied under flashesMutex, so the view
+// holds up Flash no longer than the plate has readings.
+func (s *service) Observations(plate string) []PlateReading {
+	s.flashesMutex.RLock()
+	readings := make([]PlateReading, 0)
+	for _, road := range s.plateRoads[plate] {
+		readings = append(readings, s.cameraFlashes[observationKey{Plate: plate, Road: road}]...)
+	}
+	s.flashesMutex.RUnlock()
+
+	sort.Slice(readings, func(i, j int) bool {
+		if readings[i].Road != readings[j].Road {
+			return readings[i].Road < readings[j].Road
+		}
+		return readings[i].Timestamp < readings[j].Timestamp
+	})
+
+	return readings
+}
+
+// AdminHandler serves:
+//
+//	GET /cameras          connected cameras
+//	GET /dispatchers      connected dispatchers and their queues
+//	GET /roads            speed limit and cameras of every road
+//	GET /tickets          pending, delivered and failed tickets
+//	GET /deliveries       status and delivery attempts of every ticket
+//	GET /plates/{plate}   readings of a plate
+func (s *service) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/cameras", get(func(*http.Request) any { return s.Cameras() }))
+	mux.HandleFunc("/dispatchers", get(func(*http.Request) any { return s.Dispatchers() }))
+	mux.HandleFunc("/roads", get(func(*http.Request) any { return s.Roads() }))
+	mux.HandleFunc("/tickets", get(func(*http.Request) any { return s.Tickets() }))
+	mux.HandleFunc("/deliveries", get(func(*http.Request) any { return s.Deliveries() }))
+	mux.HandleFunc("/plates/", get(func(r *http.Request) any {
+		return s.Observations(strings.TrimPrefix(r.URL.Path, "/plates/"))
+	}))
+
+	return mux
+}
+
+// get answers GET requests with the JSON encoding of what view returns.
+func get(view func(r *http.Request) any) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(view(r)); err != nil {
+			slog.Warn("admin response not sent", "path", r.URL.Path, "err", err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func getJSON(t *testing.T, h http.Handler, path string, v any) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: wrong status. expected: %d, got: %d", path, http.StatusOK, rec.Code)
+	}
+	if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+
+	sd := SpeedDaemon()
+	disconnect := sd.ConnectCamera(Camera{Road: 123, Mile: 8, Limit: 60})
+	sd.ConnectCamera(Camera{Road: 123, Mile: 9, Limit: 60})
+	disconnect()
+
+	speedingCar(sd, "UN1X", 123)
+
+	c := &fakeConn{}
+	d := &Dispatcher{Roads: []uint16{123}, Conn: c}
+	sd.RegisterDispatcher(d)
+	waitFor(t, "ticket written", func() bool { return d.out.Stats().Sent == 1 })
+	speedingCar(sd, "RE05BKG", 123)
+	waitFor(t, "second ticket written", func() bool { return d.out.Stats().Sent == 2 })
+	sd.UnregisterDispatcher(d)
+	speedingCar(sd, "AB12CDE", 123)
+
+	h := sd.AdminHandler()
+
+	var cameras []Camera
+	getJSON(t, h, "/cameras", &cameras)
+	if expect := []Camera{{Road: 123, Mile: 9, Limit: 60}}; !reflect.DeepEqual(cameras, expect) {
+		t.Fatalf("wrong cameras. expected: %v, got: %v", expect, cameras)
+	}
+
+	var roads []Road
+	getJSON(t, h, "/roads", &roads)
+	if len(roads) != 1 || roads[0].ID != 123 || roads[0].Limit != 60 {
+		t.Fatalf("wrong roads: %+v", roads)
+	}
+
+	var tickets TicketsInfo
+	getJSON(t, h, "/tickets", &tickets)
+	if len(tickets.Delivered) != 2 || len(tickets.Pending) != 1 {
+		t.Fatalf("wrong tickets. expected 2 delivered and 1 pending, got: %+v", tickets)
+	}
+	if tickets.Pending[0].Plate != "AB12CDE" {
+		t.Fatalf("wrong pending ticket: %v", tickets.Pending[0])
+	}
+
+	var readings []PlateReading
+	getJSON(t, h, "/plates/UN1X", &readings)
+	if len(readings) != 2 || readings[0].Timestamp != 0 || readings[1].Timestamp != 45 {
+		t.Fatalf("wrong readings: %v", readings)
+	}
+
+	var dispatchers []DispatcherInfo
+	getJSON(t, h, "/dispatchers", &dispatchers)
+	if len(dispatchers) != 0 {
+		t.Fatalf("no dispatcher should be connected: %v", dispatchers)
+	}
+}
+
+func TestObservationsOfOnePlate(t *testing.T) {
+
+	repo := &memoryRepository{}
+	sd, _ := NewSpeedDaemon(repo)
+	sd.Flash(PlateReading{Plate: "UN1X", Timestamp: 90, Camera: Camera{Road: 7, Mile: 1, Limit: 60}})
+	speedingCar(sd, "UN1X", 123)
+	speedingCar(sd, "RE05BKG", 123)
+	sd.Flash(PlateReading{Plate: "UN1X", Timestamp: 10, Camera: Camera{Road: 7, Mile: 2, Limit: 60}})
+
+	// restored readings are indexed like new ones
+	restored, err := NewSpeedDaemon(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []*service{sd, restored} {
+		readings := s.Observations("UN1X")
+		if len(readings) != 4 {
+			t.Fatalf("expected the 4 readings of the plate, got: %v", readings)
+		}
+		for i, expect := range []struct {
+			road      uint16
+			timestamp uint32
+		}{{7, 10}, {7, 90}, {123, 0}, {123, 45}} {
+			if r := readings[i]; r.Plate != "UN1X" || r.Road != expect.road || r.Timestamp != expect.timestamp {
+				t.Fatalf("wrong reading %d. expected road %d at %d, got: %+v", i, expect.road, expect.timestamp, r)
+			}
+		}
+	}
+	if readings := sd.Observations("NONE"); len(readings) != 0 {
+		t.Fatalf("readings for an unknown plate: %v", readings)
+	}
+}
+
+func TestAdminAPIOnlyGet(t *testing.T) {
+
+	rec := httptest.NewRecorder()
+	SpeedDaemon().AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/tickets", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("wrong status. expected: %d, got: %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
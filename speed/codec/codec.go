@@ -0,0 +1,301 @@
+// Package codec encodes and decodes the messages of the speed daemon
+// protocol. Every message starts with its type byte; numbers are big endian
+// and strings are prefixed by a single length byte.
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	TypeError         byte = 0x10
+	TypePlate         byte = 0x20
+	TypeTicket        byte = 0x21
+	TypeWantHeartbeat byte = 0x40
+	TypeHeartbeat     byte = 0x41
+	TypeIAmCamera     byte = 0x80
+	TypeIAmDispatcher byte = 0x81
+)
+
+// Name returns the name the protocol gives to a message type.
+func Name(t byte) string {
+	switch t {
+	case TypeError:
+		return "Error"
+	case TypePlate:
+		return "Plate"
+	case TypeTicket:
+		return "Ticket"
+	case TypeWantHeartbeat:
+		return "WantHeartbeat"
+	case TypeHeartbeat:
+		return "Heartbeat"
+	case TypeIAmCamera:
+		return "IAmCamera"
+	case TypeIAmDispatcher:
+		return "IAmDispatcher"
+	default:
+		return fmt.Sprintf("0x%02x", t)
+	}
+}
+
+// MaxLen is the longest string, and the most roads, a message can carry.
+const MaxLen = 255
+
+var ErrTooLong = errors.New("longer than 255")
+
+// UnknownTypeError is returned by Decode for a type byte that is not part of
+// the protocol.
+type UnknownTypeError byte
+
+func (e UnknownTypeError) Error() string {
+	return fmt.Sprintf("unknown message type: 0x%02x", byte(e))
+}
+
+// Message is any message of the protocol.
+type Message interface {
+	Type() byte
+	// Bytes returns the wire encoding, type byte included.
+	Bytes() []byte
+}
+
+// Error is sent by the server before it closes a misbehaving connection.
+type Error struct {
+	Message string `json:"msg"`
+}
+
+func (Error) Type() byte { return TypeError }
+
+func (e Error) Bytes() []byte {
+	return appendStr([]byte{TypeError}, e.Message)
+}
+
+// Plate is sent by a camera for every car it observes.
+type Plate struct {
+	Plate     string
+	Timestamp uint32
+}
+
+func (Plate) Type() byte { return TypePlate }
+
+func (p Plate) Bytes() []byte {
+	data := appendStr([]byte{TypePlate}, p.Plate)
+	return binary.BigEndian.AppendUint32(data, p.Timestamp)
+}
+
+// Ticket is sent by the server to a dispatcher.
+type Ticket struct {
+	Plate      string
+	Road       uint16
+	Mile1      uint16
+	Timestamp1 uint32
+	Mile2      uint16
+	Timestamp2 uint32
+	Speed      uint16
+}
+
+func (Ticket) Type() byte { return TypeTicket }
+
+func (t Ticket) Bytes() []byte {
+	data := appendStr([]byte{TypeTicket}, t.Plate)
+	data = binary.BigEndian.AppendUint16(data, t.Road)
+	data = binary.BigEndian.AppendUint16(data, t.Mile1)
+	data = binary.BigEndian.AppendUint32(data, t.Timestamp1)
+	data = binary.BigEndian.AppendUint16(data, t.Mile2)
+	data = binary.BigEndian.AppendUint32(data, t.Timestamp2)
+	data = binary.BigEndian.AppendUint16(data, t.Speed)
+
+	return data
+}
+
+// WantHeartbeat asks the server for a Heartbeat every Interval deciseconds.
+// Zero means no heartbeats.
+type WantHeartbeat struct {
+	Interval uint32
+}
+
+func (WantHeartbeat) Type() byte { return TypeWantHeartbeat }
+
+func (h WantHeartbeat) Bytes() []byte {
+	return binary.BigEndian.AppendUint32([]byte{TypeWantHeartbeat}, h.Interval)
+}
+
+type Heartbeat struct{}
+
+func (Heartbeat) Type() byte { return TypeHeartbeat }
+
+func (Heartbeat) Bytes() []byte {
+	return []byte{TypeHeartbeat}
+}
+
+// IAmCamera identifies a client as a camera at the given position.
+type IAmCamera struct {
+	Road  uint16
+	Mile  uint16
+	Limit uint16
+}
+
+func (IAmCamera) Type() byte { return TypeIAmCamera }
+
+func (c IAmCamera) Bytes() []byte {
+	data := binary.BigEndian.AppendUint16([]byte{TypeIAmCamera}, c.Road)
+	data = binary.BigEndian.AppendUint16(data, c.Mile)
+	return binary.BigEndian.AppendUint16(data, c.Limit)
+}
+
+// IAmDispatcher identifies a client as a dispatcher for the given roads.
+type IAmDispatcher struct {
+	Roads []uint16
+}
+
+func (IAmDispatcher) Type() byte { return TypeIAmDispatcher }
+
+func (d IAmDispatcher) Bytes() []byte {
+	data := []byte{TypeIAmDispatcher, byte(len(d.Roads))}
+	for _, r := range d.Roads {
+		data = binary.BigEndian.AppendUint16(data, r)
+	}
+	return data
+}
+
+func appendStr(data []byte, s string) []byte {
+	data = append(data, byte(len(s)))
+	return append(data, s...)
+}
+
+// Validate checks that every string and list of m fits its length byte.
+func Validate(m Message) error {
+	switch m := m.(type) {
+	case Error:
+		if len(m.Message) > MaxLen {
+			return fmt.Errorf("error message: %w", ErrTooLong)
+		}
+	case Plate:
+		if len(m.Plate) > MaxLen {
+			return fmt.Errorf("plate: %w", ErrTooLong)
+		}
+	case Ticket:
+		if len(m.Plate) > MaxLen {
+			return fmt.Errorf("plate: %w", ErrTooLong)
+		}
+	case IAmDispatcher:
+		if len(m.Roads) > MaxLen {
+			return fmt.Errorf("roads: %w", ErrTooLong)
+		}
+	}
+
+	return nil
+}
+
+// Encode validates m and writes it to w with a single Write.
+func Encode(w io.Writer, m Message) error {
+	if err := Validate(m); err != nil {
+		return err
+	}
+
+	_, err := w.Write(m.Bytes())
+	return err
+}
+
+// Decode reads exactly one message from r. It returns io.EOF if r ends
+// before the type byte and io.ErrUnexpectedEOF if it ends inside a message.
+func Decode(r io.Reader) (Message, error) {
+	var typ [1]byte
+	if _, err := io.ReadFull(r, typ[:]); err != nil {
+		return nil, err
+	}
+
+	d := decoder{r: r}
+
+	var m Message
+	switch typ[0] {
+	case TypeError:
+		m = Error{Message: d.str()}
+	case TypePlate:
+		m = Plate{Plate: d.str(), Timestamp: d.u32()}
+	case TypeTicket:
+		m = Ticket{
+			Plate:      d.str(),
+			Road:       d.u16(),
+			Mile1:      d.u16(),
+			Timestamp1: d.u32(),
+			Mile2:      d.u16(),
+			Timestamp2: d.u32(),
+			Speed:      d.u16(),
+		}
+	case TypeWantHeartbeat:
+		m = WantHeartbeat{Interval: d.u32()}
+	case TypeHeartbeat:
+		m = Heartbeat{}
+	case TypeIAmCamera:
+		m = IAmCamera{Road: d.u16(), Mile: d.u16(), Limit: d.u16()}
+	case TypeIAmDispatcher:
+		n := int(d.u8())
+		roads := make([]uint16, 0, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			roads = append(roads, d.u16())
+		}
+		m = IAmDispatcher{Roads: roads}
+	default:
+		return nil, UnknownTypeError(typ[0])
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	return m, nil
+}
+
+// decoder reads the fields of one message and keeps the first error, so a
+// message is decoded field by field and checked once.
+type decoder struct {
+	r   io.Reader
+	buf [4]byte
+	err error
+}
+
+func (d *decoder) read(n int) []byte {
+	if d.err != nil {
+		return d.buf[:n]
+	}
+	if _, err := io.ReadFull(d.r, d.buf[:n]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		d.err = err
+	}
+	return d.buf[:n]
+}
+
+func (d *decoder) u8() uint8 {
+	return d.read(1)[0]
+}
+
+func (d *decoder) u16() uint16 {
+	return binary.BigEndian.Uint16(d.read(2))
+}
+
+func (d *decoder) u32() uint32 {
+	return binary.BigEndian.Uint32(d.read(4))
+}
+
+func (d *decoder) str() string {
+	n := int(d.u8())
+	if d.err != nil || n == 0 {
+		return ""
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		d.err = err
+		return ""
+	}
+	return string(b)
+}
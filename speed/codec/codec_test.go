@@ -0,0 +1,132 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+
+	type scenario struct {
+		name  string
+		msg   Message
+		bytes []byte
+	}
+
+	// examples from the protocol specification
+	scenarios := []scenario{
+		{name: "error", msg: Error{Message: "bad"}, bytes: []byte{0x10, 0x03, 0x62, 0x61, 0x64}},
+		{name: "plate", msg: Plate{Plate: "UN1X", Timestamp: 1000}, bytes: []byte{0x20, 0x04, 0x55, 0x4e, 0x31, 0x58, 0x00, 0x00, 0x03, 0xe8}},
+		{
+			name:  "ticket",
+			msg:   Ticket{Plate: "UN1X", Road: 66, Mile1: 100, Timestamp1: 123456, Mile2: 110, Timestamp2: 123816, Speed: 10000},
+			bytes: []byte{0x21, 0x04, 0x55, 0x4e, 0x31, 0x58, 0x00, 0x42, 0x00, 0x64, 0x00, 0x01, 0xe2, 0x40, 0x00, 0x6e, 0x00, 0x01, 0xe3, 0xa8, 0x27, 0x10},
+		},
+		{name: "want heartbeat", msg: WantHeartbeat{Interval: 10}, bytes: []byte{0x40, 0x00, 0x00, 0x00, 0x0a}},
+		{name: "heartbeat", msg: Heartbeat{}, bytes: []byte{0x41}},
+		{name: "camera", msg: IAmCamera{Road: 66, Mile: 100, Limit: 60}, bytes: []byte{0x80, 0x00, 0x42, 0x00, 0x64, 0x00, 0x3c}},
+		{name: "dispatcher", msg: IAmDispatcher{Roads: []uint16{66}}, bytes: []byte{0x81, 0x01, 0x00, 0x42}},
+		{name: "dispatcher without roads", msg: IAmDispatcher{Roads: []uint16{}}, bytes: []byte{0x81, 0x00}},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			s := s
+			t.Parallel()
+
+			var buf bytes.Buffer
+			if err := Encode(&buf, s.msg); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), s.bytes) {
+				t.Fatalf("wrong encoding.\nexpected: %x\ngot:      %x", s.bytes, buf.Bytes())
+			}
+
+			got, err := Decode(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, s.msg) {
+				t.Fatalf("wrong message. expected: %#v, got: %#v", s.msg, got)
+			}
+			if buf.Len() != 0 {
+				t.Fatalf("%d bytes left after decoding", buf.Len())
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+
+	type scenario struct {
+		name  string
+		bytes []byte
+		err   error
+	}
+
+	scenarios := []scenario{
+		{name: "empty", bytes: []byte{}, err: io.EOF},
+		{name: "unknown type", bytes: []byte{0x42}, err: UnknownTypeError(0x42)},
+		{name: "truncated plate string", bytes: []byte{0x20, 0x04, 0x55, 0x4e}, err: io.ErrUnexpectedEOF},
+		{name: "plate without timestamp", bytes: []byte{0x20, 0x01, 0x55}, err: io.ErrUnexpectedEOF},
+		{name: "truncated camera", bytes: []byte{0x80, 0x00, 0x42, 0x00}, err: io.ErrUnexpectedEOF},
+		{name: "dispatcher with missing roads", bytes: []byte{0x81, 0x03, 0x00, 0x42}, err: io.ErrUnexpectedEOF},
+		{name: "truncated heartbeat interval", bytes: []byte{0x40, 0x00}, err: io.ErrUnexpectedEOF},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			s := s
+			t.Parallel()
+			_, err := Decode(bytes.NewReader(s.bytes))
+			if err != s.err {
+				t.Fatalf("wrong error. expected: %v, got: %v", s.err, err)
+			}
+		})
+	}
+}
+
+func TestEncodeTooLong(t *testing.T) {
+
+	long := strings.Repeat("A", MaxLen+1)
+
+	for _, m := range []Message{Error{Message: long}, Plate{Plate: long}, Ticket{Plate: long}, IAmDispatcher{Roads: make([]uint16, MaxLen+1)}} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, m); !errors.Is(err, ErrTooLong) {
+			t.Fatalf("%T should be rejected, got: %v", m, err)
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("%T: nothing should be written, got %d bytes", m, buf.Len())
+		}
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	f.Add([]byte{0x20, 0x04, 0x55, 0x4e, 0x31, 0x58, 0x00, 0x00, 0x03, 0xe8})
+	f.Add([]byte{0x80, 0x00, 0x42, 0x00, 0x64, 0x00, 0x3c})
+	f.Add([]byte{0x81, 0x03, 0x00, 0x42, 0x01, 0x70, 0x13, 0x88})
+	f.Add([]byte{0x40, 0x00, 0x00, 0x00, 0x0a, 0x41})
+	f.Add([]byte{0x10, 0x03, 0x62, 0x61, 0x64})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		rdr := bytes.NewReader(data)
+		m, err := Decode(rdr)
+		if err != nil {
+			return
+		}
+
+		// a decoded message encodes back to exactly the bytes it was read from
+		consumed := data[:len(data)-rdr.Len()]
+		var buf bytes.Buffer
+		if err := Encode(&buf, m); err != nil {
+			t.Fatalf("decoded message %#v does not encode: %v", m, err)
+		}
+		if !bytes.Equal(buf.Bytes(), consumed) {
+			t.Fatalf("round trip mismatch.\nread:    %x\nencoded: %x", consumed, buf.Bytes())
+		}
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+type TicketStatus string
+
+const (
+	TicketPending   TicketStatus = "pending"   // waiting for a dispatcher or for its confirmation
+	TicketDelivered TicketStatus = "delivered" // confirmed by a dispatcher
+	TicketFailed    TicketStatus = "failed"    // given up after too many failed attempts
+)
+
+var (
+	errDisconnected = errors.New("dispatcher disconnected")
+)
+
+// DeliveryAttempt is one dispatcher a ticket was handed to.
+type DeliveryAttempt struct {
+	Dispatcher string    `json:"dispatcher"`
+	Started    time.Time `json:"started"`
+	Error      string    `json:"error,omitempty"` // why the attempt failed
+}
+
+// delivery follows one ticket from the moment it is issued.
+type delivery struct {
+	Status   TicketStatus
+	Issued   time.Time
+	Attempts []DeliveryAttempt
+}
+
+// TicketDelivery is the delivery state of one ticket.
+type TicketDelivery struct {
+	Ticket   Ticket            `json:"ticket"`
+	Status   TicketStatus      `json:"status"`
+	Issued   time.Time         `json:"issued"`
+	Attempts []DeliveryAttempt `json:"attempts"`
+}
+
+// track starts following a ticket. The caller holds ticketsMutex.
+func (s *service) track(t Ticket, issued time.Time) *delivery {
+	d, ok := s.deliveries[t]
+	if !ok {
+		d = &delivery{Status: TicketPending, Issued: issued, Attempts: make([]DeliveryAttempt, 0)}
+		s.deliveries[t] = d
+	}
+	return d
+}
+
+// attempt records that t was handed to dispatcher d. The caller holds
+// ticketsMutex.
+func (s *service) attempt(t Ticket, d *Dispatcher) {
+	del := s.track(t, time.Time{})
+	del.Attempts = append(del.Attempts, DeliveryAttempt{Dispatcher: d.name(), Started: s.clock.Now()})
+}
+
+// retry records why the last attempt to deliver t failed and hands t to
+// another dispatcher, unless it failed too often. A ticket given up returns
+// the event to store once ticketsMutex is released. The caller holds
+// ticketsMutex.
+func (s *service) retry(t Ticket, reason error) (Event, bool) {
+	del := s.track(t, time.Time{})
+	failed := 0
+	if n := len(del.Attempts); n > 0 {
+		del.Attempts[n-1].Error = reason.Error()
+		for _, a := range del.Attempts {
+			if a.Error != "" {
+				failed++
+			}
+		}
+	}
+
+	if s.maxAttempts > 0 && failed >= s.maxAttempts {
+		s.log.Warn("giving up on ticket", "ticket", t, "attempts", failed, "err", reason)
+		del.Status = TicketFailed
+		s.failed = append(s.failed, t)
+		return Event{Kind: EventFailed, Time: s.clock.Now(), Ticket: &t}, true
+	}
+
+	s.deliver(t)
+	return Event{}, false
+}
+
+// requeue delivers again the tickets a dispatcher did not deliver.
+func (s *service) requeue(tickets []Ticket, reason error) {
+	if len(tickets) == 0 {
+		return
+	}
+
+	var failed []Event
+	s.ticketsMutex.Lock()
+	for _, t := range tickets {
+		if e, ok := s.retry(t, reason); ok {
+			failed = append(failed, e)
+		}
+	}
+	s.ticketsMutex.Unlock()
+
+	for _, e := range failed {
+		s.record(e)
+	}
+}
+
+// name identifies a dispatcher in delivery attempts.
+func (d *Dispatcher) name() string {
+	if d.Addr != "" {
+		return d.Addr
+	}
+	return fmt.Sprintf("dispatcher for roads %v", d.Roads)
+}
+
+// Deliveries returns the delivery state of every ticket, ordered by road
+// and time.
+func (s *service) Deliveries() []TicketDelivery {
+	s.ticketsMutex.RLock()
+	list := make([]TicketDelivery, 0, len(s.deliveries))
+	for t, d := range s.deliveries {
+		list = append(list, TicketDelivery{Ticket: t, Status: d.Status, Issued: d.Issued, Attempts: slices.Clone(d.Attempts)})
+	}
+	s.ticketsMutex.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i].Ticket, list[j].Ticket
+		if a.Road != b.Road {
+			return a.Road < b.Road
+		}
+		if a.Timestamp1 != b.Timestamp1 {
+			return a.Timestamp1 < b.Timestamp1
+		}
+		return a.Plate < b.Plate
+	})
+
+	return list
+}
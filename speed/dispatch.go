@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/mehix/protohackers/speed/ticketlog"
+	"golang.org/x/exp/slices"
+)
+
+// addPending queues a ticket until a dispatcher for its road connects.
+// The caller holds ticketsMutex.
+func (s *service) addPending(t Ticket) {
+	s.pending[t.Road] = append(s.pending[t.Road], t)
+}
+
+// removePending drops a queued ticket. The caller holds ticketsMutex.
+func (s *service) removePending(t Ticket) {
+	if idx := slices.Index(s.pending[t.Road], t); idx >= 0 {
+		s.pending[t.Road] = slices.Delete(s.pending[t.Road], idx, idx+1)
+	}
+}
+
+// SendTickets hands the tickets queued for the given roads to their
+// dispatchers, as many as their queues take. The rest stays queued and is
+// offered again once a dispatcher wrote a ticket.
+func (s *service) SendTickets(roads []uint16) {
+	s.ticketsMutex.Lock()
+	defer s.ticketsMutex.Unlock()
+
+	sent := 0
+	for _, road := range roads {
+		queue := s.pending[road]
+		for len(queue) > 0 && s.offer(queue[0]) {
+			queue = queue[1:]
+			sent++
+		}
+		if len(queue) == 0 {
+			delete(s.pending, road)
+		} else {
+			s.pending[road] = queue
+		}
+	}
+
+	if s.debugEnabled() {
+		s.log.Debug("sent pending tickets", "roads", roads, "sent", sent)
+	}
+}
+
+// SendTicket hands the ticket to exactly one dispatcher responsible for its
+// road. It returns false when none has room for it: a full queue only means
+// the dispatcher's writer is busy, so the ticket waits in the pending queue
+// until a dispatcher wrote one. The caller holds ticketsMutex.
+func (s *service) SendTicket(t Ticket) bool {
+	if s.offer(t) {
+		return true
+	}
+
+	if s.debugEnabled() {
+		s.log.Debug("no dispatcher with room for ticket", "ticket", t)
+	}
+	return false
+}
+
+// offer hands t to the first dispatcher for its road that has room for it.
+// The caller holds ticketsMutex.
+func (s *service) offer(t Ticket) bool {
+	for _, d := range s.dispatchersFor(t.Road) {
+		if d.out.Enqueue(t) {
+			s.attempt(t, d)
+			return true
+		}
+	}
+	return false
+}
+
+// hasPending reports whether tickets are waiting for any of the roads.
+func (s *service) hasPending(roads []uint16) bool {
+	s.ticketsMutex.RLock()
+	defer s.ticketsMutex.RUnlock()
+
+	for _, road := range roads {
+		if len(s.pending[road]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver sends t or queues it until a dispatcher for its road connects.
+// The caller holds ticketsMutex.
+func (s *service) deliver(t Ticket) {
+	if !s.SendTicket(t) {
+		s.addPending(t)
+	}
+}
+
+// evict closes the connection of a dispatcher whose write timed out, so its
+// session ends too. The outbox already stopped and hands its tickets to
+// other dispatchers.
+func (s *service) evict(d *Dispatcher) {
+	s.log.Warn("evicting dispatcher", "dispatcher", d.name(), "roads", d.Roads, "outbox", d.out.Stats())
+	atomic.AddUint64(&s.evicted, 1)
+
+	if c, ok := d.Conn.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+func (s *service) dispatchersFor(road uint16) []*Dispatcher {
+	s.dispatcherMutex.RLock()
+	defer s.dispatcherMutex.RUnlock()
+
+	return slices.Clone(s.dispatchers[road])
+}
+
+// TicketForRoads finds the first queued ticket for these roads on the given
+// day, deletes it from the queue and returns it.
+func (s *service) TicketForRoads(roads []uint16, day uint16) (Ticket, error) {
+
+	s.ticketsMutex.Lock()
+	defer s.ticketsMutex.Unlock()
+
+	for _, road := range roads {
+		for _, t := range s.pending[road] {
+			if dayFromTimestamp(t.Timestamp1) == day {
+				s.removePending(t)
+				return t, nil
+			}
+		}
+	}
+
+	return Ticket{}, fmt.Errorf("no tickets available")
+}
+
+// exportTicket adds a ticket to the audit trail, if there is one: once when
+// it is issued, with a nil d, and again when d delivered it.
+func (s *service) exportTicket(t Ticket, d *Dispatcher, issued time.Time) {
+	if s.export == nil {
+		return
+	}
+
+	limit, _ := s.roads.Limit(t.Road)
+	r := ticketlog.NewRecord(t, limit)
+	r.Issued = issued
+	if d != nil {
+		r.Dispatcher = d.Addr
+		r.Delivered = s.clock.Now()
+	}
+
+	if err := s.export.Write(r); err != nil {
+		s.log.Error("exporting ticket", "ticket", t, "err", err)
+	}
+}
+
+// RegisterDispatcher makes d responsible for its roads and delivers the
+// tickets already waiting for them.
+func (s *service) RegisterDispatcher(d *Dispatcher) {
+	s.log.Debug("dispatcher registered", "dispatcher", d.name(), "roads", d.Roads)
+
+	d.out = newOutbox(d.Conn, s.outboxSize, s.clock, s.confirmAfter,
+		func() {
+			if s.hasPending(d.Roads) {
+				s.SendTickets(d.Roads)
+			}
+		},
+		func(t Ticket) {
+			if s.debugEnabled() {
+				s.log.Debug("ticket delivered", "ticket", t, "dispatcher", d.name())
+			}
+			s.record(Event{Kind: EventDelivered, Ticket: &t})
+			s.ticketsMutex.Lock()
+			s.delivered = append(s.delivered, t)
+			del := s.track(t, time.Time{})
+			del.Status = TicketDelivered
+			issued := del.Issued
+			s.ticketsMutex.Unlock()
+			s.exportTicket(t, d, issued)
+		},
+		func(undelivered []Ticket, err error) {
+			// the connection is gone, or too slow to keep, hand its tickets
+			// to other dispatchers
+			s.detach(d)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				s.evict(d)
+			}
+			s.requeue(undelivered, err)
+		},
+	)
+
+	s.dispatcherMutex.Lock()
+	for _, road := range d.Roads {
+		s.dispatchers[road] = append(s.dispatchers[road], d)
+	}
+	s.dispatcherMutex.Unlock()
+
+	s.SendTickets(d.Roads)
+}
+
+// UnregisterDispatcher removes d after it disconnected cleanly. The tickets
+// it received count as delivered, those it did not receive yet go to other
+// dispatchers. Removing a dispatcher that is not registered does nothing.
+func (s *service) UnregisterDispatcher(d *Dispatcher) {
+	s.detach(d)
+	if d.out != nil {
+		s.requeue(d.out.Close(), errDisconnected)
+	}
+}
+
+// DropDispatcher removes d after its connection broke. Every ticket it did
+// not confirm yet goes to other dispatchers.
+func (s *service) DropDispatcher(d *Dispatcher, reason error) {
+	s.detach(d)
+	if d.out != nil {
+		s.requeue(d.out.Abort(), reason)
+	}
+}
+
+// detach stops handing tickets to d.
+func (s *service) detach(d *Dispatcher) {
+	s.dispatcherMutex.Lock()
+	for _, road := range d.Roads {
+		if idx := slices.Index(s.dispatchers[road], d); idx >= 0 {
+			s.dispatchers[road] = slices.Delete(s.dispatchers[road], idx, idx+1)
+		}
+		if len(s.dispatchers[road]) == 0 {
+			delete(s.dispatchers, road)
+		}
+	}
+	s.dispatcherMutex.Unlock()
+}
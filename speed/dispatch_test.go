@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mehix/protohackers/clock"
+	"github.com/mehix/protohackers/speed/codec"
+)
+
+// fakeConn records what is written to a dispatcher, or fails every write.
+// A gated fakeConn holds every write until gate is closed, then completes it.
+type fakeConn struct {
+	m      sync.Mutex
+	buf    bytes.Buffer
+	broken bool
+	gate   chan struct{}
+}
+
+func (c *fakeConn) Read(b []byte) (int, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.buf.Read(b)
+}
+
+func (c *fakeConn) Write(b []byte) (int, error) {
+	if c.gate != nil {
+		<-c.gate
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.broken {
+		return 0, errors.New("connection closed")
+	}
+	return c.buf.Write(b)
+}
+
+func (c *fakeConn) Bytes() []byte {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return append([]byte(nil), c.buf.Bytes()...)
+}
+
+// stuckConn is a dispatcher that never reads: every write fails once its
+// deadline passed.
+type stuckConn struct {
+	m         sync.Mutex
+	deadline  time.Time
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *stuckConn) SetWriteDeadline(t time.Time) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.deadline = t
+	return nil
+}
+
+func (c *stuckConn) Write(b []byte) (int, error) {
+	c.m.Lock()
+	wait := time.Until(c.deadline)
+	c.m.Unlock()
+
+	select {
+	case <-time.After(wait):
+		return 0, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *stuckConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+// waitFor polls cond until it holds or a second passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting: %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (s *service) pendingFor(road uint16) int {
+	s.ticketsMutex.RLock()
+	defer s.ticketsMutex.RUnlock()
+
+	return len(s.pending[road])
+}
+
+func (s *service) dispatcherCount(road uint16) int {
+	s.dispatcherMutex.RLock()
+	defer s.dispatcherMutex.RUnlock()
+
+	return len(s.dispatchers[road])
+}
+
+func speedingCar(sd *service, plate string, road uint16) {
+	sd.Flash(PlateReading{Plate: plate, Timestamp: 0, Camera: Camera{Road: road, Mile: 8, Limit: 60}})
+	sd.Flash(PlateReading{Plate: plate, Timestamp: 45, Camera: Camera{Road: road, Mile: 9, Limit: 60}})
+}
+
+func TestPendingTicketDeliveredOnce(t *testing.T) {
+
+	sd := SpeedDaemon()
+	speedingCar(sd, "UN1X", 123)
+
+	c1, c2 := &fakeConn{}, &fakeConn{}
+	d1 := &Dispatcher{Roads: []uint16{123}, Conn: c1}
+	sd.RegisterDispatcher(d1)
+	sd.RegisterDispatcher(&Dispatcher{Roads: []uint16{123}, Conn: c2})
+
+	expect := Ticket{Plate: "UN1X", Road: 123, Mile1: 8, Timestamp1: 0, Mile2: 9, Timestamp2: 45, Speed: 8000}.Bytes()
+	waitFor(t, "ticket written", func() bool { return d1.out.Stats().Sent == 1 })
+
+	if !bytes.Equal(c1.Bytes(), expect) {
+		t.Fatalf("wrong ticket for the first dispatcher. expected: %x, got: %x", expect, c1.Bytes())
+	}
+	if len(c2.Bytes()) != 0 {
+		t.Fatalf("ticket delivered twice: %x", c2.Bytes())
+	}
+	if sd.pendingFor(123) != 0 {
+		t.Fatalf("delivered ticket still queued: %v", sd.pending[123])
+	}
+}
+
+func TestTicketRequeuedOnWriteFailure(t *testing.T) {
+
+	sd := SpeedDaemon()
+
+	broken := &Dispatcher{Roads: []uint16{123}, Conn: &fakeConn{broken: true}}
+	sd.RegisterDispatcher(broken)
+
+	speedingCar(sd, "UN1X", 123)
+
+	waitFor(t, "ticket queued again", func() bool { return sd.pendingFor(123) == 1 })
+	if sd.dispatcherCount(123) != 0 {
+		t.Fatalf("broken dispatcher should be removed. got: %v", sd.dispatchers[123])
+	}
+
+	c := &fakeConn{}
+	sd.RegisterDispatcher(&Dispatcher{Roads: []uint16{123}, Conn: c})
+	waitFor(t, "ticket delivered to the new dispatcher", func() bool { return len(c.Bytes()) > 0 })
+}
+
+func TestFailoverToAnotherDispatcher(t *testing.T) {
+
+	sd := SpeedDaemon()
+
+	c := &fakeConn{}
+	sd.RegisterDispatcher(&Dispatcher{Roads: []uint16{123}, Conn: &fakeConn{broken: true}})
+	sd.RegisterDispatcher(&Dispatcher{Roads: []uint16{123}, Conn: c})
+
+	speedingCar(sd, "UN1X", 123)
+
+	waitFor(t, "ticket delivered to the live dispatcher", func() bool { return len(c.Bytes()) > 0 })
+	if sd.pendingFor(123) != 0 {
+		t.Fatalf("delivered ticket still queued: %v", sd.pending[123])
+	}
+}
+
+func TestSlowDispatcherEvicted(t *testing.T) {
+
+	sd := SpeedDaemon()
+
+	slow := &stuckConn{closed: make(chan struct{})}
+	sd.RegisterDispatcher(&Dispatcher{Roads: []uint16{123}, Conn: &lockedWriter{w: slow, timeout: 20 * time.Millisecond}})
+
+	speedingCar(sd, "UN1X", 123)
+	speedingCar(sd, "RE05BKG", 123)
+	speedingCar(sd, "AB12CDE", 123)
+
+	waitFor(t, "slow dispatcher evicted", func() bool { return sd.dispatcherCount(123) == 0 })
+	waitFor(t, "all tickets queued again", func() bool { return sd.pendingFor(123) == 3 })
+	select {
+	case <-slow.closed:
+	default:
+		t.Fatal("connection of the evicted dispatcher left open")
+	}
+	if n := atomic.LoadUint64(&sd.evicted); n != 1 {
+		t.Fatalf("expected 1 eviction counted, got %d", n)
+	}
+
+	c := &fakeConn{}
+	d := &Dispatcher{Roads: []uint16{123}, Conn: c}
+	sd.RegisterDispatcher(d)
+	waitFor(t, "tickets delivered to the new dispatcher", func() bool { return d.out.Stats().Sent == 3 })
+}
+
+func TestBurstDeliveredThroughFullQueue(t *testing.T) {
+
+	sd := SpeedDaemon()
+	sd.outboxSize = 4
+
+	d := &Dispatcher{Roads: []uint16{123}, Conn: &fakeConn{}}
+	sd.RegisterDispatcher(d)
+
+	burst := 10 * sd.outboxSize
+	for i := 0; i < burst; i++ {
+		speedingCar(sd, fmt.Sprintf("CAR%d", i), 123)
+	}
+
+	waitFor(t, "whole burst written", func() bool { return d.out.Stats().Sent == uint64(burst) })
+	if sd.dispatcherCount(123) != 1 {
+		t.Fatal("responsive dispatcher dropped during the burst")
+	}
+	if sd.pendingFor(123) != 0 {
+		t.Fatalf("tickets left pending: %v", sd.pending[123])
+	}
+}
+
+// withTimeout fails the test if f does not return within 2 seconds.
+func withTimeout(t *testing.T, what string, f func()) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("deadlock: %s", what)
+	}
+}
+
+func TestFullQueueWhileWriterWaitsForTickets(t *testing.T) {
+
+	sd := SpeedDaemon()
+	sd.outboxSize = 1
+
+	gate := make(chan struct{})
+	d := &Dispatcher{Roads: []uint16{123}, Conn: &fakeConn{gate: gate}}
+	sd.RegisterDispatcher(d)
+
+	// the first ticket is held in the write, the second fills the queue
+	speedingCar(sd, "UN1X", 123)
+	waitFor(t, "first ticket taken by the writer", func() bool { return d.out.Stats().Queued == 0 })
+	speedingCar(sd, "RE05BKG", 123)
+
+	withTimeout(t, "filling the queue while the writer needs ticketsMutex", func() {
+		sd.ticketsMutex.Lock()
+		defer sd.ticketsMutex.Unlock()
+
+		// the write completes and the writer blocks on ticketsMutex to
+		// look for pending tickets
+		close(gate)
+		time.Sleep(20 * time.Millisecond)
+
+		// the queue is full, so the ticket waits in the pending queue
+		sd.deliver(Ticket{Plate: "AB12CDE", Road: 123, Timestamp1: 0, Timestamp2: 45, Mile1: 8, Mile2: 9, Speed: 8000})
+	})
+
+	waitFor(t, "all tickets written", func() bool { return d.out.Stats().Sent == 3 })
+	if sd.dispatcherCount(123) != 1 || sd.pendingFor(123) != 0 {
+		t.Fatalf("dispatcher dropped or tickets left pending: %v", sd.pending[123])
+	}
+}
+
+func TestDispatcherRemovedWhenSessionEnds(t *testing.T) {
+
+	sd := SpeedDaemon()
+
+	// <-- IAmDispatcher{roads: [66, 368, 5000]}
+	c := &fakeConn{}
+	c.buf.Write([]byte{0x81, 0x03, 0x00, 0x42, 0x01, 0x70, 0x13, 0x88})
+	sd.HandleSession(context.Background(), c)
+
+	if len(sd.dispatchers) != 0 {
+		t.Fatalf("dispatcher should be removed after its session ended. got: %v", sd.dispatchers)
+	}
+
+	speedingCar(sd, "UN1X", 66)
+
+	if sd.pendingFor(66) != 1 {
+		t.Fatalf("ticket should wait for a new dispatcher. got: %v", sd.pending[66])
+	}
+}
+
+// deliveryOf returns the delivery state of the only ticket of plate.
+func (s *service) deliveryOf(t *testing.T, plate string) TicketDelivery {
+	t.Helper()
+
+	for _, d := range s.Deliveries() {
+		if d.Ticket.Plate == plate {
+			return d
+		}
+	}
+	t.Fatalf("no ticket for %s", plate)
+	return TicketDelivery{}
+}
+
+func TestUnconfirmedTicketRetriedAfterBrokenConnection(t *testing.T) {
+
+	sd := SpeedDaemon()
+	sd.confirmAfter = time.Hour
+
+	d1 := &Dispatcher{Roads: []uint16{123}, Conn: &fakeConn{}, Addr: "first"}
+	sd.RegisterDispatcher(d1)
+	speedingCar(sd, "UN1X", 123)
+	waitFor(t, "ticket written", func() bool { return d1.out.Stats().Sent == 1 })
+
+	if status := sd.deliveryOf(t, "UN1X").Status; status != TicketPending {
+		t.Fatalf("written ticket confirmed too early: %s", status)
+	}
+
+	// the connection dies right after the write
+	sd.DropDispatcher(d1, errors.New("connection reset"))
+	if sd.pendingFor(123) != 1 {
+		t.Fatalf("unconfirmed ticket not queued again: %v", sd.pending)
+	}
+
+	d2 := &Dispatcher{Roads: []uint16{123}, Conn: &fakeConn{}, Addr: "second"}
+	sd.RegisterDispatcher(d2)
+	waitFor(t, "ticket written again", func() bool { return d2.out.Stats().Sent == 1 })
+	sd.UnregisterDispatcher(d2)
+
+	del := sd.deliveryOf(t, "UN1X")
+	if del.Status != TicketDelivered {
+		t.Fatalf("ticket not delivered after a clean disconnect: %s", del.Status)
+	}
+	expect := []DeliveryAttempt{{Dispatcher: "first", Error: "connection reset"}, {Dispatcher: "second"}}
+	if len(del.Attempts) != len(expect) {
+		t.Fatalf("wrong attempts. expected: %v, got: %v", expect, del.Attempts)
+	}
+	for i, a := range del.Attempts {
+		if a.Dispatcher != expect[i].Dispatcher || a.Error != expect[i].Error || a.Started.IsZero() {
+			t.Fatalf("wrong attempt %d. expected: %v, got: %v", i, expect[i], a)
+		}
+	}
+	if len(sd.Tickets().Delivered) != 1 {
+		t.Fatalf("ticket delivered more than once: %v", sd.Tickets().Delivered)
+	}
+}
+
+func TestTicketConfirmedWhileConnectionStaysUp(t *testing.T) {
+
+	clk := clock.NewFake(time.Unix(0, 0))
+	sd := SpeedDaemon()
+	sd.clock = clk
+	sd.confirmAfter = time.Second
+
+	d := &Dispatcher{Roads: []uint16{123}, Conn: &fakeConn{}}
+	sd.RegisterDispatcher(d)
+	speedingCar(sd, "UN1X", 123)
+	speedingCar(sd, "RE05BKG", 123)
+	waitFor(t, "tickets written", func() bool { return d.out.Stats().Sent == 2 })
+
+	clk.Advance(999 * time.Millisecond)
+	if delivered := len(sd.Tickets().Delivered); delivered != 0 {
+		t.Fatalf("tickets confirmed before the window passed: %d", delivered)
+	}
+
+	clk.Advance(time.Millisecond)
+	waitFor(t, "tickets confirmed", func() bool { return len(sd.Tickets().Delivered) == 2 })
+	if stats := d.out.Stats(); stats.Unconfirmed != 0 || stats.Sent != 2 {
+		t.Fatalf("wrong stats: %+v", stats)
+	}
+}
+
+func TestFullQueueWhileTicketConfirmed(t *testing.T) {
+
+	clk := clock.NewFake(time.Unix(0, 0))
+	sd := SpeedDaemon()
+	sd.clock = clk
+	sd.confirmAfter = time.Second
+	sd.outboxSize = 1
+
+	d := &Dispatcher{Roads: []uint16{123}, Conn: &fakeConn{}}
+	sd.RegisterDispatcher(d)
+	speedingCar(sd, "UN1X", 123)
+	waitFor(t, "ticket written", func() bool { return d.out.Stats().Sent == 1 })
+
+	withTimeout(t, "filling the queue while the writer confirms a ticket", func() {
+		sd.ticketsMutex.Lock()
+		defer sd.ticketsMutex.Unlock()
+
+		// the writer blocks on ticketsMutex to mark the ticket delivered
+		clk.Advance(time.Second)
+		time.Sleep(20 * time.Millisecond)
+
+		// the first ticket fills the queue, the second waits in the pending
+		// queue
+		sd.deliver(Ticket{Plate: "RE05BKG", Road: 123, Timestamp1: 0, Timestamp2: 45, Mile1: 8, Mile2: 9, Speed: 8000})
+		sd.deliver(Ticket{Plate: "AB12CDE", Road: 123, Timestamp1: 0, Timestamp2: 45, Mile1: 8, Mile2: 9, Speed: 8000})
+	})
+
+	waitFor(t, "all tickets written", func() bool { return d.out.Stats().Sent == 3 })
+	if sd.dispatcherCount(123) != 1 || sd.pendingFor(123) != 0 {
+		t.Fatalf("dispatcher dropped or tickets left pending: %v", sd.pending[123])
+	}
+	if delivered := sd.Tickets().Delivered; len(delivered) != 1 || delivered[0].Plate != "UN1X" {
+		t.Fatalf("confirmed ticket should count as delivered: %+v", delivered)
+	}
+}
+
+func TestTicketFailsAfterMaxAttempts(t *testing.T) {
+
+	repo := &memoryRepository{}
+	sd, _ := NewSpeedDaemon(repo)
+	sd.maxAttempts = 2
+
+	speedingCar(sd, "UN1X", 123)
+	for i := 0; i < 2; i++ {
+		sd.RegisterDispatcher(&Dispatcher{Roads: []uint16{123}, Conn: &fakeConn{broken: true}})
+		waitFor(t, "broken dispatcher removed", func() bool { return sd.dispatcherCount(123) == 0 })
+	}
+
+	waitFor(t, "ticket given up", func() bool { return sd.deliveryOf(t, "UN1X").Status == TicketFailed })
+	if tickets := sd.Tickets(); len(tickets.Failed) != 1 || len(tickets.Pending) != 0 {
+		t.Fatalf("failed ticket still queued: %+v", tickets)
+	}
+
+	restored, err := NewSpeedDaemon(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tickets := restored.Tickets(); len(tickets.Failed) != 1 || len(tickets.Pending) != 0 {
+		t.Fatalf("failed ticket not restored: %+v", tickets)
+	}
+}
+
+func TestBrokenDispatcherSessionRequeues(t *testing.T) {
+
+	sd := SpeedDaemon()
+	sd.confirmAfter = time.Hour
+
+	sess := newSession(sd, &fakeConn{}, func(uint32) {})
+	if err := sess.handle(codec.IAmDispatcher{Roads: []uint16{123}}); err != nil {
+		t.Fatal(err)
+	}
+	speedingCar(sd, "UN1X", 123)
+	waitFor(t, "ticket written", func() bool { return sess.dispatcher.out.Stats().Sent == 1 })
+
+	sess.close(errors.New("connection reset"))
+
+	if sd.pendingFor(123) != 1 {
+		t.Fatalf("ticket of a broken session not queued again: %v", sd.pending)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mehix/protohackers/speed/ticketlog"
+)
+
+func TestExportIssuedAndDeliveredTickets(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "tickets.csv")
+	export, err := ticketlog.Open(path, ticketlog.CSV, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sd := SpeedDaemon()
+	sd.export = export
+
+	// issued while no dispatcher is connected, exported again once delivered
+	speedingCar(sd, "UN1X", 123)
+
+	d := &Dispatcher{Roads: []uint16{123}, Conn: &fakeConn{}, Addr: "10.0.0.1:5000"}
+	sd.RegisterDispatcher(d)
+	waitFor(t, "ticket written", func() bool { return d.out.Stats().Sent == 1 })
+	sd.UnregisterDispatcher(d)
+
+	if err := sd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	records, err := ticketlog.Read(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected the ticket exported twice, got: %v", records)
+	}
+
+	issued := records[0]
+	if issued.Plate != "UN1X" || issued.Dispatcher != "" || !issued.Delivered.IsZero() || issued.Issued.IsZero() {
+		t.Fatalf("wrong issued ticket exported: %+v", issued)
+	}
+
+	r := records[1]
+	if r.Plate != "UN1X" || r.Road != 123 || r.Limit != 60 || r.Speed != 8000 {
+		t.Fatalf("wrong ticket exported: %+v", r)
+	}
+	if !r.Issued.Equal(issued.Issued) {
+		t.Fatalf("issue time changed. expected: %v, got: %v", issued.Issued, r.Issued)
+	}
+	if r.Dispatcher != d.Addr {
+		t.Fatalf("wrong dispatcher. expected: %s, got: %s", d.Addr, r.Dispatcher)
+	}
+	if r.Issued.IsZero() || r.Delivered.Before(r.Issued) {
+		t.Fatalf("wrong times. issued: %v, delivered: %v", r.Issued, r.Delivered)
+	}
+}
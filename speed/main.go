@@ -2,254 +2,202 @@ package main
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/binary"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
+	"sync"
 	"time"
+
+	"github.com/mehix/protohackers/clock"
+	"github.com/mehix/protohackers/logging"
+	"github.com/mehix/protohackers/server"
+	"github.com/mehix/protohackers/speed/codec"
+	"github.com/mehix/protohackers/speed/ticketlog"
+)
+
+var (
+	dataFile        = flag.String("data", "", "file that keeps flashes and tickets across restarts (empty keeps them in memory, so undelivered tickets are dropped on shutdown)")
+	writeTimeout    = flag.Duration("write-timeout", 10*time.Second, "time a client gets to accept each message")
+	dispatcherQueue = flag.Int("dispatcher-queue", 64, "tickets handed to a dispatcher before it wrote them, the rest wait in the pending queue")
+	confirmAfter    = flag.Duration("confirm-after", time.Second, "time a dispatcher's connection must stay up after a ticket was written for it to count as delivered")
+	maxAttempts     = flag.Int("max-attempts", 5, "failed deliveries after which a ticket is given up (0 never gives up)")
+	adminAddr       = flag.String("admin", "", "address of the admin HTTP API (empty disables it)")
+	exportFile      = flag.String("export", "", "file that receives every ticket when it is issued and when it is delivered (empty disables the export)")
+	exportFormat    = flag.String("export-format", "json", "format of the ticket export: json or csv")
+	exportMaxSize   = flag.Int64("export-max-size", 64<<20, "size in bytes after which the ticket export is rotated (0 never rotates)")
+	exportKeep      = flag.Int("export-keep", 5, "rotated ticket exports to keep")
+	serverConfig    = server.Flags(flag.CommandLine)
+	logConfig       = logging.Flags(flag.CommandLine)
 )
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: speed <addr>")
+	flag.Parse()
+	logConfig.Install()
+	if flag.NArg() < 1 {
+		fmt.Println("Usage: speed [flags] <addr>")
 		os.Exit(1)
 	}
 
-	var sd = SpeedDaemon()
-
-	if err := sd.Start(os.Args[1]); err != nil {
-		log.Fatal(err)
+	var repo Repository = nopRepository{}
+	if *dataFile != "" {
+		fr, err := OpenFileRepository(*dataFile)
+		if err != nil {
+			fatal("opening data file", err)
+		}
+		repo = fr
 	}
-}
 
-func (s *service) Start(addr string) error {
-	l, err := net.Listen("tcp", addr)
+	sd, err := NewSpeedDaemon(repo)
 	if err != nil {
-		return err
+		fatal("restoring state", err)
 	}
-	defer l.Close()
+	sd.writeTimeout = *writeTimeout
+	sd.outboxSize = *dispatcherQueue
+	sd.confirmAfter = *confirmAfter
+	sd.maxAttempts = *maxAttempts
 
-	for {
-		conn, err := l.Accept()
+	if *exportFile != "" {
+		format, err := ticketlog.ParseFormat(*exportFormat)
 		if err != nil {
-			return err
+			fatal("choosing export format", err)
+		}
+		sd.export, err = ticketlog.Open(*exportFile, format, *exportMaxSize, *exportKeep)
+		if err != nil {
+			fatal("opening ticket export", err)
 		}
-
-		go s.HandleSession(conn)
 	}
-}
 
-var transitions = map[string]map[byte][2]string{
-	"reading": {
-		0x20: {"plateReading", "validatePlateReading"},
-		0x40: {"wantHeartbeat", "validateReadHeartbeat"},
-		0x80: {"IAmCamera", "validateStartCamera"},
-		0x81: {"IAmDispatcher", "validateStartDispatcher"},
-		'*':  {"reading", "not supported"},
-	},
-	"plateReading": {
-		0x00: {"readTimestamp", "skipEntry"},
-		'*':  {"readPlate", "setPlateLength"},
-	},
-	"readPlate": {
-		'*': {"readPlate", "addToPlate"},
-	},
-	"wantHeartbeat": {
-		'*': {"wantHeartbeat", "addToHBInterval"},
-	},
-	"IAmCamera": {
-		'*': {"IAmCamera", "addToCamera"},
-	},
-	"IAmDispatcher": {
-		0x00: {"reading", "skipEntry"},
-		'*':  {"readDispatcher", "setDispatcherLength"},
-	},
-	"readDispatcher": {
-		'*': {"readDispatcher", "addToDispatcher"},
-	},
-}
+	ctx, stop := server.SignalContext()
+	defer stop()
 
-// next returns [newState, action]
-func next(currState string, b byte) [2]string {
-	if v, ok := transitions[currState][b]; ok {
-		return v
+	reg, err := serverConfig.Metrics(ctx)
+	if err != nil {
+		fatal("starting metrics endpoint", err)
 	}
+	sd.instrument(reg)
 
-	return transitions[currState]['*']
-}
-
-func (sd *service) HandleSession(conn io.ReadWriter) {
+	srv := serverConfig.Server(flag.Arg(0), sd, reg)
 
-	state := "reading"
+	if *adminAddr != "" {
+		admin := &http.Server{Addr: *adminAddr, Handler: sd.AdminHandler()}
+		go func() {
+			slog.Info("admin API listening", "addr", *adminAddr)
+			if err := admin.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				slog.Error("admin API stopped", "err", err)
+			}
+		}()
+		defer admin.Close()
+	}
 
-	var lenToRead = 0
-	var result bytes.Buffer
-	var reading PlateReading
-	var hb WantHeartbeat
-	var dispatcher Dispatcher
+	err = srv.ListenAndServe(ctx)
+	if cerr := sd.Close(); cerr != nil {
+		slog.Error("closing the service", "err", cerr)
+	}
+	if err != nil && err != server.ErrServerClosed {
+		fatal("server stopped", err)
+	}
+}
 
-	IAmCamera := false
-	IAmDispatcher := false
+// fatal logs msg with err and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
 
-	scnr := bufio.NewScanner(conn)
-	scnr.Split(bufio.ScanBytes)
-	for scnr.Scan() {
-		b := scnr.Bytes()
-		nextStateAction := next(state, b[0])
+// ServeConn runs the session of one camera or dispatcher.
+func (s *service) ServeConn(ctx context.Context, conn net.Conn) {
+	s.HandleSession(ctx, conn)
+}
 
-		state = nextStateAction[0]
+// HandleSession reads the messages of one client until the connection ends
+// or ctx is cancelled. Any goroutine started for the session is stopped
+// before it returns.
+func (sd *service) HandleSession(ctx context.Context, rw io.ReadWriter) {
+
+	conn := &lockedWriter{w: rw, timeout: sd.writeTimeout, sent: sd.countSent}
+
+	hbCtx, stopHeartbeat := context.WithCancel(ctx)
+	var heartbeats sync.WaitGroup
+	defer func() {
+		stopHeartbeat()
+		heartbeats.Wait()
+	}()
+
+	sess := newSession(sd, conn, func(interval uint32) {
+		heartbeats.Add(1)
+		go func() {
+			defer heartbeats.Done()
+			sendHeartbeat(hbCtx, sd.clock, conn, interval)
+		}()
+	})
+	sess.log = logging.FromContext(ctx)
+	var broken error
+	defer func() { sess.close(broken) }()
+	if c, ok := rw.(interface{ RemoteAddr() net.Addr }); ok {
+		sess.addr = c.RemoteAddr().String()
+	}
 
-		switch nextStateAction[1] {
-		case "validatePlateReading":
-			if IAmDispatcher {
-				msg := Error{"dispatchers don't send plate readings"}
-				if _, err := conn.Write(msg.Bytes()); err != nil {
-					log.Printf("sending error: %v\n", err)
-				}
-				return
-			}
-			lenToRead = 0
-			result.Reset()
-		case "skipEntry":
-			// skip this byte
-		case "setPlateLength":
-			lenToRead = int(b[0]) + 4 // number + timestamp
-		case "addToPlate":
-			result.Write(b)
-			if result.Len() == lenToRead {
-				data := result.Bytes()
-				reading.Plate = string(data[:len(data)-4])
-				reading.Timestamp = binary.BigEndian.Uint32(data[len(data)-4:])
-
-				fmt.Printf("Reading: %#v\n", reading)
-				sd.Flash(reading)
-
-				result.Reset()
-				state = "reading"
-				lenToRead = 0
-			}
-		case "validateReadHeartbeat":
-			if hb.Interval > 0 {
-				// we already had a heartbeat request
-				msg := Error{"more than 1 heartbeat request"}
-				if _, err := conn.Write(msg.Bytes()); err != nil {
-					log.Printf("sending error for multiple HB: %v\n", err)
-				}
-				return
-			}
-			result.Reset()
-			lenToRead = 4
-		case "addToHBInterval":
-			result.Write(b)
-			if result.Len() == lenToRead {
-				hb.Interval = binary.BigEndian.Uint32(result.Bytes())
-
-				if hb.Interval > 0 {
-					go sendHeartbeat(conn, hb.Interval)
-				}
-
-				lenToRead = 0
-				result.Reset()
-				state = "reading"
-			}
-		case "addToCamera":
-			result.Write(b)
-			if result.Len() == 6 {
-				data := result.Bytes()
-				reading.Road = binary.BigEndian.Uint16(data[:2])
-				reading.Mile = binary.BigEndian.Uint16(data[2:4])
-				reading.Limit = binary.BigEndian.Uint16(data[4:])
-
-				lenToRead = 0
-				result.Reset()
-				state = "reading"
-			}
-		case "validateStartCamera":
-			if IAmCamera {
-				msg := Error{"already registered as a camera"}
-				if _, err := conn.Write(msg.Bytes()); err != nil {
-					log.Printf("sending error: %v\n", err)
-				}
-				return
-			}
-			if IAmDispatcher {
-				msg := Error{"already registered as a dispatcher"}
-				if _, err := conn.Write(msg.Bytes()); err != nil {
-					log.Printf("sending error: %v\n", err)
-				}
-				return
-			}
-			result.Reset()
-			lenToRead = 0
-			IAmCamera = true
-		case "validateStartDispatcher":
-			if IAmCamera {
-				msg := Error{"already registered as a camera"}
-				if _, err := conn.Write(msg.Bytes()); err != nil {
-					log.Printf("sending error: %v\n", err)
-				}
-				return
-			}
-			if IAmDispatcher {
-				msg := Error{"already registered as a dispatcher"}
-				if _, err := conn.Write(msg.Bytes()); err != nil {
-					log.Printf("sending error: %v\n", err)
-				}
-				return
-			}
-			result.Reset()
-			lenToRead = 0
-			IAmDispatcher = true
-			dispatcher = Dispatcher{Conn: conn}
-		case "setDispatcherLength":
-			lenToRead = int(b[0]) * 2 // multiplied by the number of bytes for each road (uint16)
-		case "addToDispatcher":
-			result.Write(b)
-			if result.Len() == lenToRead {
-				data := result.Bytes()
-				for i := 0; i < lenToRead; i += 2 {
-					road := binary.BigEndian.Uint16(data[i : i+2])
-					dispatcher.Roads = append(dispatcher.Roads, road)
-				}
-
-				fmt.Printf("Dispatcher (length: %d): %v\n", result.Len(), dispatcher)
-
-				sd.RegisterDispatcher(dispatcher)
-
-				lenToRead = 0
-				result.Reset()
-				state = "reading"
-			}
-		case "not supported":
-			msg := Error{"command not supported"}
-			if _, err := conn.Write(msg.Bytes()); err != nil {
-				log.Printf("sending error: %v\n", err)
+	rdr := bufio.NewReader(rw)
+	for {
+		m, err := codec.Decode(rdr)
+		if err != nil {
+			var unknown codec.UnknownTypeError
+			switch {
+			case ctx.Err() != nil:
+				sendError(conn, "server shutting down")
+			case err == io.EOF:
+			case err == io.ErrUnexpectedEOF:
+				// the client may only have closed its side of the connection
+				sd.stats.protocolErrors.Inc()
+				sendError(conn, "truncated message")
+			case errors.As(err, &unknown):
+				sd.stats.protocolErrors.Inc()
+				sendError(conn, unknown.Error())
+			default:
+				sess.log.Info("read error", "err", err)
+				broken = err
 			}
 			return
-		default:
-			fmt.Printf("unknown action: %s\n", nextStateAction[1])
 		}
-	}
 
-	if err := scnr.Err(); err != nil {
-		log.Println("read error", err)
+		if err := sess.handle(m); err != nil {
+			sess.log.Info("protocol error", "err", err)
+			sd.stats.protocolErrors.Inc()
+			sendError(conn, err.Error())
+			return
+		}
 	}
+}
 
+// sendError tells the client what it did wrong. The session ends right
+// after, so a failure to send is only logged.
+func sendError(w io.Writer, msg string) {
+	if err := codec.Encode(w, Error{Message: msg}); err != nil {
+		slog.Info("error not sent", "error", msg, "err", err)
+	}
 }
 
-func sendHeartbeat(w io.Writer, interval uint32) {
-	// TODO: close when parent closes??
-	for range time.Tick(time.Duration(interval*100) * time.Millisecond) {
-		fmt.Println("send heartbeat")
-		if l, err := w.Write([]byte{0x41}); err != nil {
-			log.Printf("sending heartbeat: %v\n", err)
+// sendHeartbeat writes a Heartbeat every interval deciseconds until ctx is
+// cancelled or a write fails.
+func sendHeartbeat(ctx context.Context, clk clock.Clock, w io.Writer, interval uint32) {
+	tkr := clk.NewTicker(time.Duration(interval) * 100 * time.Millisecond)
+	defer tkr.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
 			return
-		} else {
-			fmt.Printf("sent %d bytes\n", l)
+		case <-tkr.C():
+			if err := codec.Encode(w, codec.Heartbeat{}); err != nil {
+				logging.FromContext(ctx).Info("heartbeat not sent", "err", err)
+				return
+			}
 		}
 	}
-
 }
@@ -3,10 +3,17 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"net"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/mehix/protohackers/clock"
+	"github.com/mehix/protohackers/server"
+	"github.com/mehix/protohackers/speed/codec"
 )
 
 func TestReceiveCameraMessages(t *testing.T) {
@@ -16,9 +23,9 @@ func TestReceiveCameraMessages(t *testing.T) {
 	// <-- IAmCamera{road: 123, mile: 8, limit: 60}
 	// <-- Plate{plate: "UN1X", timestamp: 45}
 	rdr := bytes.NewReader([]byte{0x80, 0x00, 0x7b, 0x00, 0x08, 0x00, 0x3c, 0x20, 0x04, 0x55, 0x4e, 0x31, 0x58, 0x00, 0x00, 0x00, 0x2d})
-	sd.HandleSession(bufio.NewReadWriter(bufio.NewReader(rdr), nil))
+	sd.HandleSession(context.Background(), bufio.NewReadWriter(bufio.NewReader(rdr), nil))
 
-	cf, ok := sd.cameraFlashes["UN1X"]
+	cf, ok := sd.cameraFlashes[observationKey{Plate: "UN1X", Road: 123}]
 	if !ok {
 		t.Fatalf("missed camera flash. got: %v", sd.cameraFlashes)
 	}
@@ -38,7 +45,7 @@ func TestDispatcher(t *testing.T) {
 	// <-- IAmCamera{road: 123, mile: 8, limit: 60}
 	// <-- Plate{plate: "UN1X", timestamp: 45}
 	rdr := bytes.NewReader([]byte{0x81, 0x03, 0x00, 0x42, 0x01, 0x70, 0x13, 0x88})
-	sd.HandleSession(bufio.NewReadWriter(bufio.NewReader(rdr), nil))
+	sd.HandleSession(context.Background(), bufio.NewReadWriter(bufio.NewReader(rdr), nil))
 
 }
 
@@ -49,13 +56,16 @@ func TestCalculateAvgSpeed(t *testing.T) {
 	c = Camera{Road: 123, Mile: 10, Limit: 60}
 	reading2 := PlateReading{Plate: "UN1X", Timestamp: 37261183, Camera: c}
 
-	avgSpeed := calculateAvgSpeed(reading1, reading2)
+	avgSpeed, ok := calculateAvgSpeed(reading1, reading2)
+	if !ok {
+		t.Fatal("speed should be defined")
+	}
 
 	if avgSpeed != 10000 {
 		t.Fatalf("wrong average speed. expected: %d, got: %d", 10000, avgSpeed)
 	}
 
-	avgSpeed2 := calculateAvgSpeed(reading2, reading1)
+	avgSpeed2, _ := calculateAvgSpeed(reading2, reading1)
 	if avgSpeed != avgSpeed2 {
 		t.Fatal("Should be reversible")
 	}
@@ -69,12 +79,12 @@ func TestTicket(t *testing.T) {
 	// <-- IAmCamera{road: 123, mile: 8, limit: 60}
 	// <-- Plate{plate: "UN1X", timestamp: 00}
 	rdr1 := bytes.NewReader([]byte{0x80, 0x00, 0x7b, 0x00, 0x08, 0x00, 0x3c, 0x20, 0x04, 0x55, 0x4e, 0x31, 0x58, 0x00, 0x00, 0x00, 0x00})
-	sd.HandleSession(bufio.NewReadWriter(bufio.NewReader(rdr1), nil))
+	sd.HandleSession(context.Background(), bufio.NewReadWriter(bufio.NewReader(rdr1), nil))
 
 	// <-- IAmCamera{road: 123, mile: 9, limit: 60}
 	// <-- Plate{plate: "UN1X", timestamp: 45}
 	rdr2 := bytes.NewReader([]byte{0x80, 0x00, 0x7b, 0x00, 0x09, 0x00, 0x3c, 0x20, 0x04, 0x55, 0x4e, 0x31, 0x58, 0x00, 0x00, 0x00, 0x2d})
-	sd.HandleSession(bufio.NewReadWriter(bufio.NewReader(rdr2), nil))
+	sd.HandleSession(context.Background(), bufio.NewReadWriter(bufio.NewReader(rdr2), nil))
 
 	ticket, err := sd.TicketForRoads([]uint16{123}, dayFromTimestamp(0))
 	if err != nil {
@@ -126,33 +136,40 @@ func TestDecisecond(t *testing.T) {
 
 func TestServerHeartbeat(t *testing.T) {
 
-	addr := "127.0.0.1:45667"
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
 
+	clk := clock.NewFake(time.Unix(0, 0))
 	sd := SpeedDaemon()
-	go sd.Start(addr)
-
-	fmt.Println("wait for server to start")
-	time.Sleep(time.Second)
+	sd.clock = clk
+	srv := &server.Server{Handler: sd}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.Serve(ctx, l)
 
-	// client
-	fmt.Println("connecting to server")
-	c, err := net.Dial("tcp", addr)
+	c, err := net.Dial("tcp", l.Addr().String())
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer c.Close()
 
-	go func() {
-		fmt.Println("send heartbeat request")
-		c.Write([]byte{0x40, 0x00, 0x00, 0x00, 0x1a})
-	}()
+	// <-- WantHeartbeat{interval: 26}
+	c.Write([]byte{0x40, 0x00, 0x00, 0x00, 0x1a})
+	clk.BlockUntil(1)
 
-	scnr := bufio.NewScanner(c)
-	scnr.Split(bufio.ScanBytes)
-	count := 0
+	for i := 0; i < 5; i++ {
+		clk.Advance(2600 * time.Millisecond)
 
-	for count < 5 && scnr.Scan() {
-		fmt.Printf("Received: %v\n", scnr.Bytes())
-		count++
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		m, err := codec.Decode(c)
+		if err != nil {
+			t.Fatalf("heartbeat %d: %v", i+1, err)
+		}
+		if m != (codec.Heartbeat{}) {
+			t.Fatalf("expected a heartbeat, got: %v", m)
+		}
 	}
 }
 
@@ -164,3 +181,51 @@ func TestDayFromTimestamp(t *testing.T) {
 		fmt.Printf("%d -> %d\n", t, dayFromTimestamp(t))
 	}
 }
+
+// countingWriter counts the heartbeats written to it.
+type countingWriter struct {
+	count int32
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	atomic.AddInt32(&w.count, 1)
+	return len(b), nil
+}
+
+func TestHeartbeatStopsWithSession(t *testing.T) {
+
+	clk := clock.NewFake(time.Unix(0, 0))
+	sd := SpeedDaemon()
+	sd.clock = clk
+
+	// <-- WantHeartbeat{interval: 1}, then the connection stays open until closed
+	rdr, client := io.Pipe()
+	w := &countingWriter{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sd.HandleSession(context.Background(), struct {
+			io.Reader
+			io.Writer
+		}{rdr, w})
+	}()
+	client.Write([]byte{0x40, 0x00, 0x00, 0x00, 0x01})
+
+	clk.BlockUntil(1)
+	for i := 0; i < 3; i++ {
+		clk.Advance(100 * time.Millisecond)
+		want := int32(i + 1)
+		waitFor(t, "heartbeat written", func() bool { return atomic.LoadInt32(&w.count) == want })
+	}
+
+	client.Close()
+	<-done
+
+	if clk.Waiters() != 0 {
+		t.Fatal("heartbeat ticker still running after the session ended")
+	}
+	clk.Advance(time.Second)
+	if sent := atomic.LoadInt32(&w.count); sent != 3 {
+		t.Fatalf("heartbeats sent after the session ended: %d", sent)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/mehix/protohackers/metrics"
+	"github.com/mehix/protohackers/speed/codec"
+)
+
+// stats are the counters the service updates as it goes. They are nil, and
+// count nothing, until instrument is called.
+type stats struct {
+	received       *metrics.CounterVec // messages from clients, by type
+	sent           *metrics.CounterVec // messages to clients, by type
+	protocolErrors *metrics.Counter
+}
+
+// instrument exposes the state of the service in r.
+func (s *service) instrument(r *metrics.Registry) {
+	s.stats = stats{
+		received:       r.CounterVec("speed_messages_received_total", "Messages received from clients, by type.", "type"),
+		sent:           r.CounterVec("speed_messages_sent_total", "Messages sent to clients, by type.", "type"),
+		protocolErrors: r.Counter("speed_protocol_errors_total", "Sessions ended for breaking the protocol."),
+	}
+
+	r.GaugeFunc("speed_cameras", "Connected cameras.", func() int64 {
+		s.camerasMutex.RLock()
+		defer s.camerasMutex.RUnlock()
+		return int64(len(s.cameras))
+	})
+	r.GaugeFunc("speed_dispatchers", "Connected dispatchers.", func() int64 {
+		return int64(len(s.Dispatchers()))
+	})
+	r.CounterFunc("speed_dispatchers_evicted_total", "Dispatchers dropped after a ticket write timed out.", func() uint64 {
+		return atomic.LoadUint64(&s.evicted)
+	})
+
+	r.CounterFunc("speed_tickets_issued_total", "Tickets issued.", func() uint64 {
+		s.ticketsMutex.RLock()
+		defer s.ticketsMutex.RUnlock()
+		return uint64(len(s.deliveries))
+	})
+	r.GaugeFunc("speed_tickets_pending", "Tickets not delivered yet, queued or waiting for their dispatcher's confirmation.", func() int64 {
+		s.ticketsMutex.RLock()
+		defer s.ticketsMutex.RUnlock()
+		pending := 0
+		for _, d := range s.deliveries {
+			if d.Status == TicketPending {
+				pending++
+			}
+		}
+		return int64(pending)
+	})
+	r.CounterFunc("speed_tickets_delivered_total", "Tickets confirmed by a dispatcher.", func() uint64 {
+		s.ticketsMutex.RLock()
+		defer s.ticketsMutex.RUnlock()
+		return uint64(len(s.delivered))
+	})
+	r.CounterFunc("speed_tickets_failed_total", "Tickets given up after too many failed deliveries.", func() uint64 {
+		s.ticketsMutex.RLock()
+		defer s.ticketsMutex.RUnlock()
+		return uint64(len(s.failed))
+	})
+}
+
+// countSent is called by a session's lockedWriter for every message it
+// wrote.
+func (s *service) countSent(typ byte) {
+	s.stats.sent.With(codec.Name(typ)).Inc()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mehix/protohackers/metrics"
+	"github.com/mehix/protohackers/speed/codec"
+)
+
+func TestMetrics(t *testing.T) {
+
+	reg := metrics.NewRegistry()
+	sd := SpeedDaemon()
+	sd.instrument(reg)
+
+	camera := codec.IAmCamera{Road: 123, Mile: 8, Limit: 60}.Bytes()
+	plate := codec.Plate{Plate: "UN1X", Timestamp: 45}.Bytes()
+	runSession(sd, join(camera, plate, plate, codec.Heartbeat{}.Bytes()))
+	speedingCar(sd, "FAST", 7)
+
+	var b strings.Builder
+	reg.WriteTo(&b)
+	out := b.String()
+
+	for _, sample := range []string{
+		`speed_messages_received_total{type="IAmCamera"} 1`,
+		`speed_messages_received_total{type="Plate"} 2`,
+		`speed_messages_received_total{type="Heartbeat"} 1`,
+		`speed_messages_sent_total{type="Error"} 1`,
+		`speed_protocol_errors_total 1`,
+		`speed_cameras 0`,
+		`speed_tickets_issued_total 1`,
+		`speed_tickets_pending 1`,
+		`speed_tickets_delivered_total 0`,
+	} {
+		if !strings.Contains(out, sample+"\n") {
+			t.Errorf("missing %s in:\n%s", sample, out)
+		}
+	}
+}
@@ -1,9 +1,9 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
 	"io"
+
+	"github.com/mehix/protohackers/speed/codec"
 )
 
 type PlateReading struct {
@@ -20,48 +20,13 @@ type Camera struct {
 
 type Dispatcher struct {
 	Roads []uint16
-	Conn  io.ReadWriter
-}
-
-type Ticket struct {
-	Plate      string
-	Road       uint16
-	Mile1      uint16
-	Timestamp1 uint32
-	Mile2      uint16
-	Timestamp2 uint32
-	Speed      uint16
-}
-
-func (t Ticket) Bytes() []byte {
-	var buf bytes.Buffer
-	buf.WriteByte(0x21)
-	buf.WriteByte(byte(len(t.Plate)))
-	buf.Write([]byte(t.Plate))
-	data := buf.Bytes()
-	data = binary.BigEndian.AppendUint16(data, t.Road)
-	data = binary.BigEndian.AppendUint16(data, t.Mile1)
-	data = binary.BigEndian.AppendUint32(data, t.Timestamp1)
-	data = binary.BigEndian.AppendUint16(data, t.Mile2)
-	data = binary.BigEndian.AppendUint32(data, t.Timestamp2)
-	data = binary.BigEndian.AppendUint16(data, t.Speed)
-
-	return data
+	Conn  io.Writer
+	Addr  string // remote address, if the connection has one
+	out   *outbox
 }
 
-type WantHeartbeat struct {
-	Interval uint32
-}
-
-type Error struct {
-	Message string `json:"msg"`
-}
-
-func (e Error) Bytes() []byte {
-	m := []byte(e.Message)
-	var buf bytes.Buffer
-	buf.WriteByte(0x10)
-	buf.WriteByte(byte(len(m)))
-	buf.Write(m)
-	return buf.Bytes()
-}
+type (
+	Ticket        = codec.Ticket
+	WantHeartbeat = codec.WantHeartbeat
+	Error         = codec.Error
+)
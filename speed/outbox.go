@@ -0,0 +1,299 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mehix/protohackers/clock"
+	"github.com/mehix/protohackers/speed/codec"
+)
+
+// lockedWriter serializes the writes to a session's connection. Heartbeats,
+// errors and tickets are written from different goroutines and each message
+// is a single Write, so they never interleave. When the connection supports
+// deadlines every write must finish within timeout.
+type lockedWriter struct {
+	m       sync.Mutex
+	w       io.Writer
+	timeout time.Duration
+	sent    func(typ byte) // called with the type of every message written, if set
+}
+
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+func (lw *lockedWriter) Write(b []byte) (int, error) {
+	lw.m.Lock()
+	defer lw.m.Unlock()
+
+	if dw, ok := lw.w.(writeDeadliner); ok && lw.timeout > 0 {
+		dw.SetWriteDeadline(time.Now().Add(lw.timeout))
+	}
+
+	n, err := lw.w.Write(b)
+	if err == nil && len(b) > 0 && lw.sent != nil {
+		lw.sent(b[0])
+	}
+	return n, err
+}
+
+// Close closes the connection, if it can be closed.
+func (lw *lockedWriter) Close() error {
+	if c, ok := lw.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// outbox is the outbound ticket queue of one dispatcher. Tickets are written
+// by the outbox's own goroutine, so a slow dispatcher only delays itself.
+//
+// The protocol has no acknowledgement, so a written ticket only counts as
+// delivered once the connection stayed up for confirmAfter, or the
+// dispatcher disconnected cleanly. Until then a broken connection hands the
+// ticket back for another dispatcher.
+type outbox struct {
+	w            io.Writer
+	queue        chan Ticket
+	clock        clock.Clock
+	confirmAfter time.Duration
+
+	// onWritten is called after every successful write, when the queue has
+	// room again.
+	onWritten func()
+	// onDelivered receives every ticket confirmed as delivered.
+	onDelivered func(Ticket)
+	// onFail receives the tickets left undelivered after a write failed.
+	onFail func(undelivered []Ticket, err error)
+	// The callbacks run on the outbox goroutine and may take ticketsMutex,
+	// so Close and Abort, which wait for that goroutine, must not be called
+	// while holding it.
+
+	m           sync.Mutex
+	closed      bool
+	peak        int
+	unconfirmed []writtenTicket
+
+	sent   uint64
+	failed uint64
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+type writtenTicket struct {
+	Ticket
+	at time.Time
+}
+
+// outboxStats shows how far behind a dispatcher is.
+type outboxStats struct {
+	Queued      int    `json:"queued"`
+	Peak        int    `json:"peak"`
+	Sent        uint64 `json:"sent"`
+	Unconfirmed int    `json:"unconfirmed"` // written, not yet counted as delivered
+	Failed      uint64 `json:"failed"`
+}
+
+func newOutbox(w io.Writer, size int, clk clock.Clock, confirmAfter time.Duration, onWritten func(), onDelivered func(Ticket), onFail func([]Ticket, error)) *outbox {
+	o := &outbox{
+		w:            w,
+		queue:        make(chan Ticket, size),
+		clock:        clk,
+		confirmAfter: confirmAfter,
+		onWritten:    onWritten,
+		onDelivered:  onDelivered,
+		onFail:       onFail,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go o.run()
+
+	return o
+}
+
+// Enqueue adds t to the queue. It returns false when the queue is full or
+// the outbox is closed.
+func (o *outbox) Enqueue(t Ticket) bool {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	if o.closed {
+		return false
+	}
+
+	select {
+	case o.queue <- t:
+		if l := len(o.queue); l > o.peak {
+			o.peak = l
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops the outbox after the dispatcher disconnected cleanly. The
+// written tickets are confirmed, those never written are returned.
+func (o *outbox) Close() []Ticket {
+	o.shutdown()
+
+	for _, t := range o.takeUnconfirmed() {
+		o.onDelivered(t)
+	}
+
+	return o.drain()
+}
+
+// Abort stops the outbox of a broken connection and returns every ticket
+// not confirmed yet, written or not.
+func (o *outbox) Abort() []Ticket {
+	o.shutdown()
+
+	undelivered := o.takeUnconfirmed()
+	atomic.AddUint64(&o.failed, uint64(len(undelivered)))
+
+	return append(undelivered, o.drain()...)
+}
+
+func (o *outbox) shutdown() {
+	o.m.Lock()
+	o.closed = true
+	o.m.Unlock()
+
+	o.stopOnce.Do(func() { close(o.stop) })
+	<-o.done
+}
+
+func (o *outbox) Stats() outboxStats {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	return outboxStats{
+		Queued:      len(o.queue),
+		Peak:        o.peak,
+		Sent:        atomic.LoadUint64(&o.sent),
+		Unconfirmed: len(o.unconfirmed),
+		Failed:      atomic.LoadUint64(&o.failed),
+	}
+}
+
+func (o *outbox) run() {
+	undelivered, err := o.write()
+
+	close(o.done)
+
+	if err != nil {
+		o.onFail(undelivered, err)
+	}
+}
+
+// write sends the queued tickets until the outbox is stopped or a write
+// fails. After a failure it returns the failed ticket, the unconfirmed ones
+// and everything still queued.
+func (o *outbox) write() ([]Ticket, error) {
+	confirm := o.clock.NewTimer(o.confirmAfter)
+	confirm.Stop()
+	defer confirm.Stop()
+
+	for {
+		// once stopped, write nothing more even if tickets are queued
+		select {
+		case <-o.stop:
+			return nil, nil
+		default:
+		}
+
+		select {
+		case <-o.stop:
+			return nil, nil
+		case <-confirm.C():
+			if next, ok := o.confirm(o.clock.Now()); ok {
+				confirm.Reset(next)
+			}
+		case t := <-o.queue:
+			if err := codec.Encode(o.w, t); err != nil {
+				slog.Info("ticket not sent", "ticket", t, "err", err)
+
+				o.m.Lock()
+				o.closed = true
+				o.m.Unlock()
+
+				undelivered := append([]Ticket{t}, o.takeUnconfirmed()...)
+				atomic.AddUint64(&o.failed, uint64(len(undelivered)))
+
+				return append(undelivered, o.drain()...), err
+			}
+			if o.confirmAfter <= 0 {
+				o.onDelivered(t)
+			} else {
+				o.m.Lock()
+				o.unconfirmed = append(o.unconfirmed, writtenTicket{Ticket: t, at: o.clock.Now()})
+				first := len(o.unconfirmed) == 1
+				o.m.Unlock()
+
+				if first {
+					confirm.Reset(o.confirmAfter)
+				}
+			}
+			atomic.AddUint64(&o.sent, 1)
+
+			o.onWritten()
+		}
+	}
+}
+
+// confirm delivers the tickets written at least confirmAfter before now. It
+// returns when the next unconfirmed ticket is due, if there is one.
+func (o *outbox) confirm(now time.Time) (time.Duration, bool) {
+	o.m.Lock()
+	due := 0
+	for due < len(o.unconfirmed) && now.Sub(o.unconfirmed[due].at) >= o.confirmAfter {
+		due++
+	}
+	confirmed := o.unconfirmed[:due]
+	o.unconfirmed = append([]writtenTicket(nil), o.unconfirmed[due:]...)
+
+	var next time.Duration
+	left := len(o.unconfirmed) > 0
+	if left {
+		next = o.confirmAfter - now.Sub(o.unconfirmed[0].at)
+	}
+	o.m.Unlock()
+
+	for _, t := range confirmed {
+		o.onDelivered(t.Ticket)
+	}
+
+	return next, left
+}
+
+func (o *outbox) takeUnconfirmed() []Ticket {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	tickets := make([]Ticket, 0, len(o.unconfirmed))
+	for _, t := range o.unconfirmed {
+		tickets = append(tickets, t.Ticket)
+	}
+	o.unconfirmed = nil
+
+	return tickets
+}
+
+func (o *outbox) drain() []Ticket {
+	unsent := make([]Ticket, 0)
+	for {
+		select {
+		case t := <-o.queue:
+			unsent = append(unsent, t)
+		default:
+			return unsent
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+type EventKind string
+
+const (
+	EventFlash     EventKind = "flash"     // a plate reading was received
+	EventTicket    EventKind = "ticket"    // a ticket is waiting for a dispatcher
+	EventDelivered EventKind = "delivered" // a dispatcher confirmed a ticket
+	EventFailed    EventKind = "failed"    // a ticket was given up after too many attempts
+)
+
+// Event is one change to the state of the service. Replaying the events in
+// order restores the observations, the pending tickets and the tickets that
+// were already delivered.
+type Event struct {
+	Kind   EventKind     `json:"kind"`
+	Time   time.Time     `json:"time,omitempty"`
+	Flash  *PlateReading `json:"flash,omitempty"`
+	Ticket *Ticket       `json:"ticket,omitempty"`
+}
+
+// Repository stores the events of the service so they survive a restart.
+type Repository interface {
+	Append(e Event) error
+	// Events returns every stored event in the order it was appended.
+	Events() ([]Event, error)
+	// Durable reports whether the events outlive the process.
+	Durable() bool
+	Close() error
+}
+
+// nopRepository stores nothing, for a service that keeps its state only in
+// memory. Nothing reads the events back before a restart, so keeping them
+// would only grow with every reading.
+type nopRepository struct{}
+
+func (nopRepository) Append(e Event) error     { return nil }
+func (nopRepository) Events() ([]Event, error) { return nil, nil }
+func (nopRepository) Durable() bool            { return false }
+func (nopRepository) Close() error             { return nil }
+
+// fileRepository appends the events to a file, one JSON document per line.
+type fileRepository struct {
+	f *os.File
+	m sync.Mutex
+}
+
+func OpenFileRepository(path string) (*fileRepository, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	// terminate a line left incomplete by a crash so new events start on a line of their own
+	if fi, err := f.Stat(); err == nil && fi.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, fi.Size()-1); err == nil && last[0] != '\n' {
+			f.Write([]byte{'\n'})
+		}
+	}
+
+	return &fileRepository{f: f}, nil
+}
+
+func (r *fileRepository) Append(e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	_, err = r.f.Write(append(data, '\n'))
+	return err
+}
+
+// Events reads the file from the start. A damaged line, for example one
+// only partly written before a crash, is skipped.
+func (r *fileRepository) Events() ([]Event, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	f, err := os.Open(r.f.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	events := make([]Event, 0)
+	scnr := bufio.NewScanner(f)
+	line := 0
+	for scnr.Scan() {
+		line++
+		var e Event
+		if err := json.Unmarshal(scnr.Bytes(), &e); err != nil {
+			slog.Warn("skipping damaged event", "file", r.f.Name(), "line", line, "err", err)
+			continue
+		}
+		events = append(events, e)
+	}
+
+	if err := scnr.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", r.f.Name(), err)
+	}
+
+	return events, nil
+}
+
+func (r *fileRepository) Durable() bool { return true }
+
+func (r *fileRepository) Close() error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if err := r.f.Sync(); err != nil {
+		r.f.Close()
+		return err
+	}
+	return r.f.Close()
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileRepositoryRestoresPendingTickets(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "speed.jsonl")
+
+	repo, err := OpenFileRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, err := NewSpeedDaemon(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c1 := Camera{Road: 123, Mile: 8, Limit: 60}
+	c2 := Camera{Road: 123, Mile: 9, Limit: 60}
+	sd.Flash(PlateReading{Plate: "UN1X", Timestamp: 0, Camera: c1})
+	sd.Flash(PlateReading{Plate: "UN1X", Timestamp: 45, Camera: c2})
+
+	if err := sd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err = OpenFileRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := NewSpeedDaemon(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	if len(restored.cameraFlashes[observationKey{Plate: "UN1X", Road: 123}]) != 2 {
+		t.Fatalf("wrong number of restored flashes. expected: 2, got: %d", len(restored.cameraFlashes[observationKey{Plate: "UN1X", Road: 123}]))
+	}
+
+	ticket, err := restored.TicketForRoads([]uint16{123}, dayFromTimestamp(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ticket.Speed != 8000 {
+		t.Fatalf("wrong speed for restored ticket. expected: 8000, got: %d", ticket.Speed)
+	}
+}
+
+func TestFileRepositorySkipsDamagedLine(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "speed.jsonl")
+	content := `{"kind":"flash","flash":{"Plate":"UN1X","Timestamp":45,"Road":123,"Mile":8,"Limit":60}}` + "\n" +
+		`{"kind":"flash","flash":{"Plate":"UN1X","Tim`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := OpenFileRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	if err := repo.Append(Event{Kind: EventFlash, Flash: &PlateReading{Plate: "RE05BKG", Timestamp: 10}}); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := repo.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("wrong number of events. expected: 2, got: %d", len(events))
+	}
+	if events[1].Flash.Plate != "RE05BKG" {
+		t.Fatalf("wrong plate for the appended event. expected: RE05BKG, got: %s", events[1].Flash.Plate)
+	}
+}
+
+func TestPendingTicketsSurviveShutdown(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "speed.jsonl")
+
+	repo, err := OpenFileRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, err := NewSpeedDaemon(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd.confirmAfter = time.Hour
+
+	// one ticket written but not confirmed when its dispatcher is cut off by
+	// the shutdown, one that never found a dispatcher
+	d := &Dispatcher{Roads: []uint16{123}, Conn: &fakeConn{}}
+	sd.RegisterDispatcher(d)
+	speedingCar(sd, "UN1X", 123)
+	waitFor(t, "ticket written", func() bool { return d.out.Stats().Sent == 1 })
+	speedingCar(sd, "RE05BKG", 456)
+
+	sd.DropDispatcher(d, errors.New("server shutting down"))
+	if err := sd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err = OpenFileRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := NewSpeedDaemon(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	if n := len(restored.Tickets().Pending); n != 2 {
+		t.Fatalf("expected 2 pending tickets after the restart, got %d", n)
+	}
+
+	for _, road := range []uint16{123, 456} {
+		c := &fakeConn{}
+		d := &Dispatcher{Roads: []uint16{road}, Conn: c}
+		restored.RegisterDispatcher(d)
+		waitFor(t, "restored ticket delivered", func() bool { return d.out.Stats().Sent == 1 })
+	}
+}
+
+func TestCloseReportsDroppedTickets(t *testing.T) {
+
+	var logged bytes.Buffer
+	sd := SpeedDaemon()
+	sd.log = slog.New(slog.NewTextHandler(&logged, nil))
+
+	speedingCar(sd, "UN1X", 123)
+	if err := sd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(logged.String(), "dropping undelivered tickets") || !strings.Contains(logged.String(), "tickets=1") {
+		t.Fatalf("ticket lost without a data file not reported:\n%s", logged.String())
+	}
+}
+
+// memoryRepository keeps the events in memory, so a test can restore a
+// service from them.
+type memoryRepository struct {
+	m      sync.Mutex
+	events []Event
+}
+
+func (r *memoryRepository) Append(e Event) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.events = append(r.events, e)
+	return nil
+}
+
+func (r *memoryRepository) Events() ([]Event, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return append([]Event(nil), r.events...), nil
+}
+
+// Durable is true: the tests restore a service from the same repository.
+func (r *memoryRepository) Durable() bool {
+	return true
+}
+
+func (r *memoryRepository) Close() error {
+	return nil
+}
+
+// lockCheckingRepository notes the events stored while ticketsMutex is held.
+// Other goroutines take it only briefly, so a lock that stays taken is held
+// by the caller of Append.
+type lockCheckingRepository struct {
+	nopRepository
+	sd *service
+
+	m      sync.Mutex
+	locked []EventKind
+}
+
+func (r *lockCheckingRepository) Append(e Event) error {
+	deadline := time.Now().Add(100 * time.Millisecond)
+	for !r.sd.ticketsMutex.TryLock() {
+		if time.Now().After(deadline) {
+			r.m.Lock()
+			r.locked = append(r.locked, e.Kind)
+			r.m.Unlock()
+			return r.nopRepository.Append(e)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	r.sd.ticketsMutex.Unlock()
+
+	return r.nopRepository.Append(e)
+}
+
+func TestEventsStoredWithoutTicketsLock(t *testing.T) {
+
+	repo := &lockCheckingRepository{}
+	sd, _ := NewSpeedDaemon(repo)
+	repo.sd = sd
+	sd.maxAttempts = 1
+	sd.confirmAfter = 0
+
+	speedingCar(sd, "UN1X", 123)
+	sd.RegisterDispatcher(&Dispatcher{Roads: []uint16{123}, Conn: &fakeConn{broken: true}})
+	waitFor(t, "ticket given up", func() bool { return sd.deliveryOf(t, "UN1X").Status == TicketFailed })
+
+	d := &Dispatcher{Roads: []uint16{123}, Conn: &fakeConn{}}
+	sd.RegisterDispatcher(d)
+	speedingCar(sd, "RE05BKG", 123)
+	waitFor(t, "ticket delivered", func() bool { return sd.deliveryOf(t, "RE05BKG").Status == TicketDelivered })
+
+	repo.m.Lock()
+	defer repo.m.Unlock()
+	if len(repo.locked) != 0 {
+		t.Fatalf("events stored while holding ticketsMutex: %v", repo.locked)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"sync"
+
+	"golang.org/x/exp/slices"
+)
+
+// Road is what the cameras told us about a road.
+type Road struct {
+	ID    uint16 `json:"road"`
+	Limit uint16 `json:"limit"`
+	// Cameras holds the miles of the cameras seen on the road.
+	Cameras []uint16 `json:"cameras"`
+	// Conflicts holds the other limits reported by cameras on the road.
+	Conflicts []uint16 `json:"conflicts,omitempty"`
+}
+
+// roadRegistry keeps the speed limit of every road. The first camera
+// reporting a road sets its limit; cameras that disagree are logged and
+// recorded as conflicts but do not change it.
+type roadRegistry struct {
+	roads map[uint16]*Road
+	m     sync.RWMutex
+}
+
+func newRoadRegistry() *roadRegistry {
+	return &roadRegistry{roads: make(map[uint16]*Road)}
+}
+
+// Register records a camera and returns the limit of its road.
+func (r *roadRegistry) Register(c Camera) uint16 {
+	r.m.RLock()
+	road, ok := r.roads[c.Road]
+	known := ok && road.Limit == c.Limit && slices.Contains(road.Cameras, c.Mile)
+	r.m.RUnlock()
+	if known {
+		return road.Limit
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	road, ok = r.roads[c.Road]
+	if !ok {
+		road = &Road{ID: c.Road, Limit: c.Limit}
+		r.roads[c.Road] = road
+	}
+
+	if !slices.Contains(road.Cameras, c.Mile) {
+		road.Cameras = append(road.Cameras, c.Mile)
+		slices.Sort(road.Cameras)
+	}
+
+	if c.Limit != road.Limit && !slices.Contains(road.Conflicts, c.Limit) {
+		slog.Warn("conflicting limit", "road", c.Road, "mile", c.Mile, "limit", c.Limit, "kept", road.Limit)
+		road.Conflicts = append(road.Conflicts, c.Limit)
+	}
+
+	return road.Limit
+}
+
+// Limit returns the speed limit of a road, if any camera reported it.
+func (r *roadRegistry) Limit(road uint16) (uint16, bool) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	if rd, ok := r.roads[road]; ok {
+		return rd.Limit, true
+	}
+	return 0, false
+}
+
+// Roads returns a copy of every known road, ordered by ID.
+func (r *roadRegistry) Roads() []Road {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	roads := make([]Road, 0, len(r.roads))
+	for _, rd := range r.roads {
+		roads = append(roads, Road{
+			ID:        rd.ID,
+			Limit:     rd.Limit,
+			Cameras:   slices.Clone(rd.Cameras),
+			Conflicts: slices.Clone(rd.Conflicts),
+		})
+	}
+
+	sort.Slice(roads, func(i, j int) bool {
+		return roads[i].ID < roads[j].ID
+	})
+
+	return roads
+}
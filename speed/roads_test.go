@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoadRegistry(t *testing.T) {
+
+	r := newRoadRegistry()
+
+	if limit := r.Register(Camera{Road: 1, Mile: 8, Limit: 60}); limit != 60 {
+		t.Fatalf("wrong limit. expected: 60, got: %d", limit)
+	}
+	if limit := r.Register(Camera{Road: 1, Mile: 9, Limit: 80}); limit != 60 {
+		t.Fatalf("a conflicting camera changed the limit. expected: 60, got: %d", limit)
+	}
+	r.Register(Camera{Road: 1, Mile: 10, Limit: 80})
+	r.Register(Camera{Road: 2, Mile: 1, Limit: 100})
+
+	expect := []Road{
+		{ID: 1, Limit: 60, Cameras: []uint16{8, 9, 10}, Conflicts: []uint16{80}},
+		{ID: 2, Limit: 100, Cameras: []uint16{1}},
+	}
+	if got := r.Roads(); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("wrong roads.\nexpected: %+v\ngot:      %+v", expect, got)
+	}
+
+	if _, ok := r.Limit(3); ok {
+		t.Fatal("unknown road should have no limit")
+	}
+}
+
+func TestTicketUsesRoadLimit(t *testing.T) {
+
+	sd := SpeedDaemon()
+
+	// the road's limit is 100; the second camera wrongly reports 60
+	sd.RegisterCamera(Camera{Road: 1, Mile: 8, Limit: 100})
+	sd.Flash(PlateReading{Plate: "UN1X", Timestamp: 0, Camera: Camera{Road: 1, Mile: 8, Limit: 100}})
+	sd.Flash(PlateReading{Plate: "UN1X", Timestamp: 45, Camera: Camera{Road: 1, Mile: 9, Limit: 60}})
+
+	// 80 mph is within the limit of the road
+	if sd.pendingFor(1) != 0 {
+		t.Fatalf("ticket issued against the conflicting limit: %v", sd.pending[1])
+	}
+}
@@ -1,75 +1,236 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"log/slog"
 	"math"
 	"sort"
 	"sync"
+	"time"
 
+	"github.com/mehix/protohackers/clock"
+	"github.com/mehix/protohackers/speed/ticketlog"
 	"golang.org/x/exp/slices"
 )
 
 type service struct {
-	cameraFlashes   map[string][]PlateReading // plate => []cameraFlash
+	cameraFlashes   map[observationKey][]PlateReading // (plate, road) => readings ordered by timestamp
+	plateRoads      map[string][]uint16               // plate => roads it was read on, guarded by flashesMutex
 	flashesMutex    sync.RWMutex
-	tickets         map[uint16]map[uint16][]Ticket // road => day => []Ticket
+	pending         map[uint16][]Ticket // road => tickets waiting for a dispatcher
+	delivered       []Ticket
+	failed          []Ticket
+	deliveries      map[Ticket]*delivery // ticket => delivery state
 	ticketsMutex    sync.RWMutex
-	dispatchers     []Dispatcher
+	ticketed        ticketedDays             // plate => days with a ticket, guarded by ticketsMutex
+	dispatchers     map[uint16][]*Dispatcher // road => dispatchers
 	dispatcherMutex sync.RWMutex
-	repo            repository
+	roads           *roadRegistry
+	cameras         map[*Camera]struct{} // connected cameras
+	camerasMutex    sync.RWMutex
+	evicted         uint64 // dispatchers dropped after a write timed out
+	repo            Repository
+	export          *ticketlog.Writer // audit trail of issued and delivered tickets, nil disables it
+	log             *slog.Logger
+	stats           stats
+
+	writeTimeout time.Duration // for every write to a client
+	outboxSize   int           // tickets handed to a dispatcher before it wrote them
+	clock        clock.Clock
+	confirmAfter time.Duration // a written ticket counts as delivered once its connection survived this long
+	maxAttempts  int           // failed deliveries after which a ticket is given up, 0 never gives up
 }
 
-type repository struct {
-	flashes      []PlateReading
-	flashesMutex sync.RWMutex
-	tickets      []Ticket
-	ticketsMutex sync.RWMutex
+// SpeedDaemon creates a service that keeps its state only in memory.
+func SpeedDaemon() *service {
+	sd, _ := NewSpeedDaemon(nopRepository{})
+	return sd
 }
 
-func SpeedDaemon() *service {
-	return &service{
-		cameraFlashes: make(map[string][]PlateReading),
-		tickets:       make(map[uint16]map[uint16][]Ticket),
+// NewSpeedDaemon creates a service that records its events in repo and
+// restores the state from the events already stored there.
+func NewSpeedDaemon(repo Repository) (*service, error) {
+	s := &service{
+		cameraFlashes: make(map[observationKey][]PlateReading),
+		plateRoads:    make(map[string][]uint16),
+		pending:       make(map[uint16][]Ticket),
+		deliveries:    make(map[Ticket]*delivery),
+		ticketed:      make(ticketedDays),
+		dispatchers:   make(map[uint16][]*Dispatcher),
+		roads:         newRoadRegistry(),
+		cameras:       make(map[*Camera]struct{}),
+		repo:          repo,
+		log:           slog.Default(),
+		clock:         clock.Real,
+		writeTimeout:  10 * time.Second,
+		outboxSize:    64,
+		confirmAfter:  time.Second,
+		maxAttempts:   5,
+	}
+
+	events, err := repo.Events()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range events {
+		s.replay(e)
+	}
+
+	if len(events) > 0 {
+		s.log.Info("restored state", "events", len(events))
+	}
+
+	return s, nil
+}
+
+// replay applies a stored event without deciding on new tickets, those
+// decisions were stored as events of their own.
+func (s *service) replay(e Event) {
+	switch e.Kind {
+	case EventFlash:
+		if e.Flash == nil {
+			return
+		}
+		s.roads.Register(e.Flash.Camera)
+		s.insertFlash(*e.Flash)
+	case EventTicket:
+		if e.Ticket == nil {
+			return
+		}
+		s.ticketed.Add(*e.Ticket)
+		s.addPending(*e.Ticket)
+		s.track(*e.Ticket, e.Time)
+	case EventDelivered:
+		if e.Ticket == nil {
+			return
+		}
+		s.removePending(*e.Ticket)
+		s.ticketed.Add(*e.Ticket)
+		s.delivered = append(s.delivered, *e.Ticket)
+		s.track(*e.Ticket, e.Time).Status = TicketDelivered
+	case EventFailed:
+		if e.Ticket == nil {
+			return
+		}
+		s.removePending(*e.Ticket)
+		s.ticketed.Add(*e.Ticket)
+		s.failed = append(s.failed, *e.Ticket)
+		s.track(*e.Ticket, e.Time).Status = TicketFailed
+	default:
+		s.log.Warn("unknown event", "kind", e.Kind)
+	}
+}
+
+func (s *service) record(e Event) {
+	if e.Time.IsZero() {
+		e.Time = s.clock.Now()
+	}
+	if err := s.repo.Append(e); err != nil {
+		s.log.Error("storing event", "kind", e.Kind, "err", err)
 	}
 }
 
 const tolerance = 50
 
+// observationKey groups the readings that can be compared with each other:
+// those of the same car on the same road.
+type observationKey struct {
+	Plate string
+	Road  uint16
+}
+
+// RegisterCamera records the position of a camera and the limit it reports
+// for its road.
+func (s *service) RegisterCamera(c Camera) {
+	s.roads.Register(c)
+}
+
+// ConnectCamera registers the camera of a session. The camera counts as
+// connected until disconnect is called.
+func (s *service) ConnectCamera(c Camera) (disconnect func()) {
+	s.RegisterCamera(c)
+
+	cam := &c
+	s.camerasMutex.Lock()
+	s.cameras[cam] = struct{}{}
+	s.camerasMutex.Unlock()
+
+	return func() {
+		s.camerasMutex.Lock()
+		delete(s.cameras, cam)
+		s.camerasMutex.Unlock()
+	}
+}
+
+// Roads returns what is known about every road.
+func (s *service) Roads() []Road {
+	return s.roads.Roads()
+}
+
+// Flash stores a reading and compares it with the readings right before and
+// right after it on the same road, against the limit in the road registry.
 func (s *service) Flash(p PlateReading) {
-	fmt.Printf("Register flash: %v\n", p)
+	debug := s.debugEnabled()
+	if debug {
+		s.log.Debug("flash", "reading", p)
+	}
+
+	limit := s.roads.Register(p.Camera)
 
 	s.flashesMutex.Lock()
-	arr := s.cameraFlashes[p.Plate]
-	arr = append(arr, p)
-	sort.Slice(arr, func(i, j int) bool {
-		return arr[i].Timestamp < arr[j].Timestamp
-	})
-	s.cameraFlashes[p.Plate] = arr
+	neighbours := s.insertFlash(p)
 	s.flashesMutex.Unlock()
 
-	if pr, ok := s.cameraFlashes[p.Plate]; ok {
-		fmt.Printf("Found flashes for plate: %v\n", p.Plate)
-		for i := 0; i < len(pr)-1; i++ {
-			// measurings are already ordered by timestamp
-			// check each consecutive pair
-			avgSpeed := calculateAvgSpeed(pr[i], pr[i+1])
-			if avgSpeed >= p.Limit*100+tolerance {
-				fmt.Printf("Average speed exceeds limit: %v >= %v + %d\n", avgSpeed, p.Limit*100, tolerance)
-				// need a ticket
-				s.RegisterTicket(pr[i], pr[i+1], avgSpeed)
-				//return
-			} else {
-				fmt.Printf("Average speed within limits: %v\n", avgSpeed)
+	s.record(Event{Kind: EventFlash, Flash: &p})
+
+	for _, n := range neighbours {
+		speed, ok := speedHundredths(n, p)
+		if !ok {
+			if debug {
+				s.log.Debug("readings at the same time", "plate", p.Plate, "timestamp", p.Timestamp)
 			}
+			continue
+		}
+		if speed >= uint64(limit)*100+tolerance {
+			// need a ticket
+			avgSpeed, _ := calculateAvgSpeed(n, p)
+			s.RegisterTicket(n, p, avgSpeed)
+		} else if debug {
+			s.log.Debug("average speed within limit", "plate", p.Plate, "road", p.Road, "speed", speed, "limit", limit)
 		}
 	}
 }
 
-func (s *service) RegisterTicket(reading1, reading2 PlateReading, speed uint16) {
-	s.ticketsMutex.Lock()
-	defer s.ticketsMutex.Unlock()
+// insertFlash adds p to the readings of its car on its road, keeping them
+// ordered by timestamp, and returns the readings next to it. The caller
+// holds flashesMutex.
+func (s *service) insertFlash(p PlateReading) []PlateReading {
+	key := observationKey{Plate: p.Plate, Road: p.Road}
+	arr := s.cameraFlashes[key]
+	if len(arr) == 0 {
+		s.plateRoads[p.Plate] = append(s.plateRoads[p.Plate], p.Road)
+	}
+
+	// readings mostly arrive in order, so this usually appends
+	idx := sort.Search(len(arr), func(i int) bool {
+		return arr[i].Timestamp > p.Timestamp
+	})
+	arr = slices.Insert(arr, idx, p)
+	s.cameraFlashes[key] = arr
+
+	neighbours := make([]PlateReading, 0, 2)
+	if idx > 0 {
+		neighbours = append(neighbours, arr[idx-1])
+	}
+	if idx < len(arr)-1 {
+		neighbours = append(neighbours, arr[idx+1])
+	}
+
+	return neighbours
+}
 
+func (s *service) RegisterTicket(reading1, reading2 PlateReading, speed uint16) {
 	first := reading1
 	second := reading2
 	if reading2.Timestamp < reading1.Timestamp {
@@ -86,170 +247,109 @@ func (s *service) RegisterTicket(reading1, reading2 PlateReading, speed uint16)
 		Speed:      speed,
 	}
 
-	day := dayFromTimestamp(first.Timestamp)
-
-	if slices.Contains(s.tickets[reading1.Road][day], ticket) {
-		return
-	}
-
-	if !s.SendTicket(ticket) {
-		if s.tickets[reading1.Road] == nil {
-			s.tickets[reading1.Road] = make(map[uint16][]Ticket)
-		}
-		if s.tickets[reading1.Road][day] == nil {
-			s.tickets[reading1.Road][day] = make([]Ticket, 0)
-		}
-		s.tickets[reading1.Road][day] = append(s.tickets[reading1.Road][day], ticket)
-	}
-}
-
-func (s *service) SendTickets() {
-	fmt.Println("Try to send tickets")
 	s.ticketsMutex.Lock()
-	defer s.ticketsMutex.Unlock()
-
-	sentTickets := make([]Ticket, 0)
-	for _, ticketsByDay := range s.tickets {
-		for _, tickets := range ticketsByDay {
-			for _, t := range tickets {
-				if s.SendTicket(t) {
-					sentTickets = append(sentTickets, t)
-				}
-			}
-		}
-	}
-
-	fmt.Printf("Count sent tickets: %d\n", len(sentTickets))
-	for _, t := range sentTickets {
-		day := dayFromTimestamp(t.Timestamp1)
-		if idx := slices.Index(s.tickets[t.Road][day], t); idx >= 0 {
-			fmt.Println("Remove sent ticket")
-			s.tickets[t.Road][day] = slices.Delete(s.tickets[t.Road][day], idx, idx)
-		}
-	}
-}
-
-// yyyy-MM-dd => []Ticket
-var sentTicketsByDay = make(map[string][]Ticket)
-
-func (s *service) SendTicket(t Ticket) bool {
-
-	key := fmt.Sprintf("%s-%d", t.Plate, t.Road)
-	for _, oldTicket := range sentTicketsByDay[key] {
-		// check if we need a new ticket
-		if (t.Mile1 == oldTicket.Mile1 && t.Timestamp1 == oldTicket.Timestamp1) ||
-			(oldTicket.Mile2 == t.Mile2 && oldTicket.Timestamp2 == t.Timestamp2) ||
-			(oldTicket.Mile1 == t.Mile2 && oldTicket.Timestamp1 == t.Timestamp2) ||
-			(oldTicket.Mile2 == t.Mile1 && oldTicket.Timestamp2 == t.Timestamp1) {
-			fmt.Printf("(1) Ticket old: %v\n", oldTicket)
-			fmt.Printf("(1) Ticket new: %v\n", t)
-			return true
-		}
-
-		if dayFromTimestamp(oldTicket.Timestamp1) == dayFromTimestamp(t.Timestamp1) || dayFromTimestamp(oldTicket.Timestamp2) == dayFromTimestamp(t.Timestamp2) {
-			fmt.Printf("(2) Ticket old: %v\n", oldTicket)
-			fmt.Printf("(2) Ticket new: %v\n", t)
-			return true
-		}
-
-		if dayFromTimestamp(oldTicket.Timestamp1) != dayFromTimestamp(t.Timestamp1) &&
-			dayFromTimestamp(oldTicket.Timestamp2) != dayFromTimestamp(t.Timestamp2) &&
-			dayFromTimestamp(oldTicket.Timestamp2) == dayFromTimestamp(t.Timestamp1) {
-			// different days, send ticket
-			continue
-		}
-
-		if dayFromTimestamp(oldTicket.Timestamp1) == dayFromTimestamp(oldTicket.Timestamp2) &&
-			dayFromTimestamp(t.Timestamp1) == dayFromTimestamp(t.Timestamp2) &&
-			dayFromTimestamp(oldTicket.Timestamp1) != dayFromTimestamp(t.Timestamp1) {
-			// different days, send ticket
-			continue
-		}
-
-		if oldTicket.Mile1 >= t.Mile1 && oldTicket.Mile2 <= t.Mile2 {
-			fmt.Printf("(3) Ticket old: %v\n", oldTicket)
-			fmt.Printf("(3) Ticket new: %v\n", t)
-			return true
+	if s.ticketed.Ticketed(ticket) {
+		s.ticketsMutex.Unlock()
+		if s.debugEnabled() {
+			s.log.Debug("already ticketed on these days", "ticket", ticket)
 		}
+		return
 	}
+	s.ticketed.Add(ticket)
+	e := Event{Kind: EventTicket, Time: s.clock.Now(), Ticket: &ticket}
+	s.track(ticket, e.Time)
+	s.ticketsMutex.Unlock()
 
-	fmt.Printf("SendTicket: %v\n", t)
-	// find a dispatcher and try to send the ticket
-	s.dispatcherMutex.RLock()
-	defer s.dispatcherMutex.RUnlock()
-
-	for _, d := range s.dispatchers {
-		fmt.Printf("Check dispatcher: %v\n", d)
-		for _, r := range d.Roads {
-			fmt.Printf("Check road: %v\n", r)
-			if r == t.Road {
-				if _, err := d.Conn.Write(t.Bytes()); err != nil {
-					log.Printf("sending ticket: %v\n", err)
-					// continue and try to find another dispatcher
-					break
-				} else {
-					fmt.Printf("Ticket sent: %v, for date: %s\n", t, key)
-					sentTicketsByDay[key] = append(sentTicketsByDay[key], t)
-					return true
-				}
-			}
-		}
+	if s.debugEnabled() {
+		s.log.Debug("ticket issued", "ticket", ticket)
 	}
-
-	fmt.Printf("Ticket not sent: %v\n", t)
-	return false
-}
-
-// TicketForRoad finds the first available ticket for this road, deletes it from the system and returns it
-func (s *service) TicketForRoads(roads []uint16, day uint16) (Ticket, error) {
+	// stored before it is handed to a dispatcher, so its EventDelivered
+	// always follows it in the log
+	s.record(e)
+	s.exportTicket(ticket, nil, e.Time)
 
 	s.ticketsMutex.Lock()
-	defer s.ticketsMutex.Unlock()
-
-	for _, road := range roads {
-		tickets := s.tickets[road][day]
-		if len(tickets) > 0 {
-			ticket := tickets[0]
-			s.tickets[road][day] = tickets[1:]
-			return ticket, nil
-		}
-	}
+	s.deliver(ticket)
+	s.ticketsMutex.Unlock()
+}
 
-	return Ticket{}, fmt.Errorf("no tickets available")
+// debugEnabled reports whether debug entries are logged, so the hot paths
+// only build them when they are.
+func (s *service) debugEnabled() bool {
+	return s.log.Enabled(context.Background(), slog.LevelDebug)
 }
 
 func dayFromTimestamp(t uint32) uint16 {
 	return uint16(math.Floor(float64(t) / 86400))
 }
 
-func calculateAvgSpeed(reading1, reading2 PlateReading) uint16 {
+// maxSpeed is the highest speed a ticket can carry, in hundredths of mph.
+const maxSpeed = math.MaxUint16
+
+// speedHundredths returns the exact average speed between two readings in
+// hundredths of mph, rounded down. ok is false for readings taken at the
+// same time, which have no meaningful speed.
+func speedHundredths(reading1, reading2 PlateReading) (speed uint64, ok bool) {
 	// cars travel in both directions, so one reading can have bigger timestamp but smaller miles
-	distance := float64(reading1.Camera.Mile - reading2.Camera.Mile)
+	distance := uint64(reading1.Camera.Mile - reading2.Camera.Mile)
 	if reading1.Camera.Mile < reading2.Camera.Mile {
-		distance = float64(reading2.Camera.Mile - reading1.Camera.Mile)
+		distance = uint64(reading2.Camera.Mile - reading1.Camera.Mile)
 	}
 
-	time := float64(reading1.Timestamp - reading2.Timestamp)
+	time := uint64(reading1.Timestamp - reading2.Timestamp)
 	if reading1.Timestamp < reading2.Timestamp {
-		time = float64(reading2.Timestamp - reading1.Timestamp)
+		time = uint64(reading2.Timestamp - reading1.Timestamp)
+	}
+
+	if time == 0 {
+		return 0, false
 	}
 
-	fmt.Printf("Distance: %f, Time: %f\n", distance, time)
-	return uint16(distance / time * 3600 * 100)
+	// at most 65535 miles * 360000, far from overflowing
+	return distance * 3600 * 100 / time, true
 }
 
-func (s *service) RegisterFlash(r PlateReading) {
-	s.repo.flashesMutex.Lock()
-	s.repo.flashes = append(s.repo.flashes, r)
-	s.repo.flashesMutex.Unlock()
+// calculateAvgSpeed returns the average speed as carried by a ticket: in
+// hundredths of mph, saturated at maxSpeed.
+func calculateAvgSpeed(reading1, reading2 PlateReading) (uint16, bool) {
+	speed, ok := speedHundredths(reading1, reading2)
+	if !ok {
+		return 0, false
+	}
+	if speed > maxSpeed {
+		return maxSpeed, true
+	}
+	return uint16(speed), true
 }
 
-func (s *service) RegisterDispatcher(d Dispatcher) {
-	fmt.Printf("Register dispatcher: %v\n", d)
-	s.dispatcherMutex.Lock()
-	s.dispatchers = append(s.dispatchers, d)
-	s.dispatcherMutex.Unlock()
+// Close is called after the server stopped serving sessions, so no
+// dispatcher is left to take the tickets still pending. With a durable
+// repository they are not lost: each was stored as an EventTicket when
+// issued and, lacking an EventDelivered, is pending again once the next
+// start replays the repository. Otherwise they are dropped. Close reports
+// them and closes the export and the repository.
+func (s *service) Close() error {
+	s.ticketsMutex.RLock()
+	defer s.ticketsMutex.RUnlock()
+
+	pending := 0
+	for _, tickets := range s.pending {
+		pending += len(tickets)
+	}
+
+	switch {
+	case pending == 0:
+	case s.repo.Durable():
+		s.log.Warn("shutting down with undelivered tickets, they are delivered after a restart", "tickets", pending)
+	default:
+		s.log.Warn("shutting down without a data file, dropping undelivered tickets", "tickets", pending)
+	}
+
+	if s.export != nil {
+		if err := s.export.Close(); err != nil {
+			s.log.Error("closing ticket export", "err", err)
+		}
+	}
 
-	// TODO try to send tickets
-	s.SendTickets()
+	return s.repo.Close()
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"math/big"
+	"sort"
+	"testing"
+	"testing/quick"
+)
+
+func TestFlashComparesOnlySameRoad(t *testing.T) {
+
+	sd := SpeedDaemon()
+
+	// 1 mile in 45 seconds would be 80 mph, but the readings are on different roads
+	sd.Flash(PlateReading{Plate: "UN1X", Timestamp: 0, Camera: Camera{Road: 1, Mile: 8, Limit: 60}})
+	sd.Flash(PlateReading{Plate: "UN1X", Timestamp: 45, Camera: Camera{Road: 2, Mile: 9, Limit: 60}})
+
+	if sd.pendingFor(1)+sd.pendingFor(2) != 0 {
+		t.Fatalf("readings from different roads were compared: %v", sd.pending)
+	}
+}
+
+func TestFlashOutOfOrder(t *testing.T) {
+
+	sd := SpeedDaemon()
+
+	c := func(mile uint16) Camera { return Camera{Road: 1, Mile: mile, Limit: 60} }
+
+	// the middle reading arrives last; only its pair with the first one is too fast
+	sd.Flash(PlateReading{Plate: "UN1X", Timestamp: 0, Camera: c(0)})
+	sd.Flash(PlateReading{Plate: "UN1X", Timestamp: 7200, Camera: c(110)})
+	sd.Flash(PlateReading{Plate: "UN1X", Timestamp: 3600, Camera: c(100)})
+
+	readings := sd.cameraFlashes[observationKey{Plate: "UN1X", Road: 1}]
+	if !sort.SliceIsSorted(readings, func(i, j int) bool { return readings[i].Timestamp < readings[j].Timestamp }) {
+		t.Fatalf("readings not ordered by timestamp: %v", readings)
+	}
+
+	ticket, err := sd.TicketForRoads([]uint16{1}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ticket.Timestamp1 != 0 || ticket.Timestamp2 != 3600 {
+		t.Fatalf("ticket for the wrong pair of readings: %v", ticket)
+	}
+}
+
+func BenchmarkFlashManySightings(b *testing.B) {
+
+	sd := SpeedDaemon()
+
+	// a slow car seen by cameras a mile apart every two minutes
+	for i := 0; i < b.N; i++ {
+		sd.Flash(PlateReading{Plate: "UN1X", Timestamp: uint32(i) * 120, Camera: Camera{Road: 1, Mile: uint16(i), Limit: 60}})
+	}
+}
+
+// referenceSpeed computes the speed in hundredths of mph with arbitrary
+// precision: |mile1-mile2| / |t1-t2| hours, times 100, rounded down and
+// saturated at the limit of the protocol.
+func referenceSpeed(mile1, mile2 uint16, t1, t2 uint32) (uint16, bool) {
+	if t1 == t2 {
+		return 0, false
+	}
+
+	distance := new(big.Int).Abs(new(big.Int).Sub(big.NewInt(int64(mile1)), big.NewInt(int64(mile2))))
+	hours := new(big.Rat).SetFrac(
+		new(big.Int).Abs(new(big.Int).Sub(big.NewInt(int64(t1)), big.NewInt(int64(t2)))),
+		big.NewInt(3600),
+	)
+	speed := new(big.Rat).Quo(new(big.Rat).SetInt(distance), hours)
+	speed.Mul(speed, big.NewRat(100, 1))
+
+	floor := new(big.Int).Quo(speed.Num(), speed.Denom())
+	if floor.Cmp(big.NewInt(maxSpeed)) > 0 {
+		return maxSpeed, true
+	}
+	return uint16(floor.Int64()), true
+}
+
+func TestCalculateAvgSpeedMatchesReference(t *testing.T) {
+
+	check := func(mile1, mile2 uint16, t1, t2 uint32) bool {
+		r1 := PlateReading{Timestamp: t1, Camera: Camera{Mile: mile1}}
+		r2 := PlateReading{Timestamp: t2, Camera: Camera{Mile: mile2}}
+
+		expect, expectOk := referenceSpeed(mile1, mile2, t1, t2)
+		got, ok := calculateAvgSpeed(r1, r2)
+		reversed, reversedOk := calculateAvgSpeed(r2, r1)
+
+		return ok == expectOk && got == expect && reversedOk == ok && reversed == got
+	}
+
+	if err := quick.Check(check, &quick.Config{MaxCount: 10000}); err != nil {
+		t.Fatal(err)
+	}
+
+	// short intervals, where saturation and rounding matter most
+	closeInTime := func(mile1, mile2 uint16, t1 uint32, dt uint8) bool {
+		return check(mile1, mile2, t1, t1+uint32(dt))
+	}
+
+	if err := quick.Check(closeInTime, &quick.Config{MaxCount: 10000}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCalculateAvgSpeedEdgeCases(t *testing.T) {
+
+	type scenario struct {
+		name   string
+		mile1  uint16
+		mile2  uint16
+		t1     uint32
+		t2     uint32
+		speed  uint16
+		usable bool
+	}
+
+	scenarios := []scenario{
+		{name: "same time", mile1: 1, mile2: 2, t1: 10, t2: 10},
+		{name: "same place", mile1: 5, mile2: 5, t1: 10, t2: 20, speed: 0, usable: true},
+		{name: "655.35 mph", mile1: 0, mile2: 65535, t1: 0, t2: 360000, speed: 65535, usable: true},
+		{name: "above 655.35 mph saturates", mile1: 0, mile2: 1000, t1: 0, t2: 1, speed: maxSpeed, usable: true},
+		{name: "rounds down", mile1: 0, mile2: 1, t1: 0, t2: 7, speed: 51428, usable: true},
+		{name: "widest interval", mile1: 0, mile2: 1, t1: 0, t2: 1<<32 - 1, speed: 0, usable: true},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			s := s
+			t.Parallel()
+			r1 := PlateReading{Timestamp: s.t1, Camera: Camera{Mile: s.mile1}}
+			r2 := PlateReading{Timestamp: s.t2, Camera: Camera{Mile: s.mile2}}
+			speed, ok := calculateAvgSpeed(r1, r2)
+			if ok != s.usable {
+				t.Fatalf("wrong usable flag. expected: %v, got: %v", s.usable, ok)
+			}
+			if speed != s.speed {
+				t.Fatalf("wrong speed. expected: %d, got: %d", s.speed, speed)
+			}
+		})
+	}
+}
+
+func TestTicketAboveLimitOf655(t *testing.T) {
+
+	sd := SpeedDaemon()
+
+	// 1000 miles in one hour on a road limited to 700 mph
+	sd.Flash(PlateReading{Plate: "UN1X", Timestamp: 0, Camera: Camera{Road: 1, Mile: 0, Limit: 700}})
+	sd.Flash(PlateReading{Plate: "UN1X", Timestamp: 3600, Camera: Camera{Road: 1, Mile: 1000, Limit: 700}})
+
+	ticket, err := sd.TicketForRoads([]uint16{1}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ticket.Speed != maxSpeed {
+		t.Fatalf("wrong speed. expected: %d, got: %d", maxSpeed, ticket.Speed)
+	}
+}
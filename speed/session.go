@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/mehix/protohackers/speed/codec"
+)
+
+// role is what a client identified itself as. A client starts without a
+// role and may pick one once.
+type role int
+
+const (
+	roleNone role = iota
+	roleCamera
+	roleDispatcher
+)
+
+func (r role) String() string {
+	switch r {
+	case roleCamera:
+		return "camera"
+	case roleDispatcher:
+		return "dispatcher"
+	default:
+		return "unidentified"
+	}
+}
+
+// protocolError is a message the client was not allowed to send. The
+// session replies with it as an Error and ends.
+type protocolError string
+
+func (e protocolError) Error() string { return string(e) }
+
+// session is the state of one client connection. handle applies the
+// messages one at a time, so a session can be driven without a connection.
+type session struct {
+	sd   *service
+	conn io.Writer
+	addr string // remote address of the client, if known
+	log  *slog.Logger
+
+	role          role
+	camera        Camera
+	dispatcher    *Dispatcher
+	wantHeartbeat bool
+
+	// startHeartbeat is called for a WantHeartbeat with a non-zero interval.
+	startHeartbeat func(interval uint32)
+	// disconnectCamera is set once the client is a camera.
+	disconnectCamera func()
+}
+
+func newSession(sd *service, conn io.Writer, startHeartbeat func(interval uint32)) *session {
+	return &session{
+		sd:               sd,
+		conn:             conn,
+		log:              slog.Default(),
+		startHeartbeat:   startHeartbeat,
+		disconnectCamera: func() {},
+	}
+}
+
+// handle applies one message from the client. Every message a client may
+// send is allowed in these roles:
+//
+//	WantHeartbeat   any role, once per connection
+//	IAmCamera       no role yet; the client becomes a camera
+//	IAmDispatcher   no role yet; the client becomes a dispatcher
+//	Plate           camera
+func (s *session) handle(m codec.Message) error {
+	s.sd.stats.received.With(codec.Name(m.Type())).Inc()
+
+	if ctx := context.Background(); s.log.Enabled(ctx, slog.LevelDebug) {
+		s.log.LogAttrs(ctx, slog.LevelDebug, "message", slog.String("type", fmt.Sprintf("0x%02x", m.Type())), slog.Any("message", m))
+	}
+
+	switch m := m.(type) {
+	case codec.WantHeartbeat:
+		if s.wantHeartbeat {
+			return protocolError("more than 1 heartbeat request")
+		}
+		s.wantHeartbeat = true
+		if m.Interval > 0 {
+			s.startHeartbeat(m.Interval)
+		}
+
+	case codec.IAmCamera:
+		if err := s.identify(roleCamera); err != nil {
+			return err
+		}
+		s.camera = Camera{Road: m.Road, Mile: m.Mile, Limit: m.Limit}
+		s.log = s.log.With("role", roleCamera.String(), "road", m.Road, "mile", m.Mile)
+		s.disconnectCamera = s.sd.ConnectCamera(s.camera)
+
+	case codec.IAmDispatcher:
+		if err := s.identify(roleDispatcher); err != nil {
+			return err
+		}
+		// a dispatcher for no roads never gets a ticket, but it is allowed
+		s.dispatcher = &Dispatcher{Roads: m.Roads, Conn: s.conn, Addr: s.addr}
+		s.log = s.log.With("role", roleDispatcher.String(), "roads", m.Roads)
+		s.sd.RegisterDispatcher(s.dispatcher)
+
+	case codec.Plate:
+		switch s.role {
+		case roleDispatcher:
+			return protocolError("dispatchers don't send plate readings")
+		case roleNone:
+			return protocolError("plate reading before IAmCamera")
+		}
+		if m.Plate == "" {
+			return protocolError("empty plate")
+		}
+		reading := PlateReading{Plate: m.Plate, Timestamp: m.Timestamp, Camera: s.camera}
+		s.sd.Flash(reading)
+
+	default:
+		return protocolError(fmt.Sprintf("message type 0x%02x is only sent by the server", m.Type()))
+	}
+
+	return nil
+}
+
+// identify gives the client its role, unless it already has one.
+func (s *session) identify(r role) error {
+	if s.role != roleNone {
+		return protocolError("already registered as a " + s.role.String())
+	}
+	s.role = r
+	return nil
+}
+
+// close releases what the session registered with the service. broken is
+// the error that ended the connection, nil if it ended cleanly.
+func (s *session) close(broken error) {
+	if s.dispatcher != nil {
+		if broken != nil {
+			s.sd.DropDispatcher(s.dispatcher, broken)
+		} else {
+			s.sd.UnregisterDispatcher(s.dispatcher)
+		}
+	}
+	s.disconnectCamera()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/mehix/protohackers/speed/codec"
+)
+
+// runSession feeds input to a session and returns everything it wrote.
+func runSession(sd *service, input []byte) []codec.Message {
+	var out bytes.Buffer
+	sd.HandleSession(context.Background(), struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader(input), &out})
+
+	msgs := make([]codec.Message, 0)
+	for {
+		m, err := codec.Decode(&out)
+		if err != nil {
+			return msgs
+		}
+		msgs = append(msgs, m)
+	}
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestRejectedSequences(t *testing.T) {
+
+	camera := codec.IAmCamera{Road: 123, Mile: 8, Limit: 60}.Bytes()
+	dispatcher := codec.IAmDispatcher{Roads: []uint16{123}}.Bytes()
+	plate := codec.Plate{Plate: "UN1X", Timestamp: 45}.Bytes()
+	heartbeat := codec.WantHeartbeat{Interval: 0}.Bytes()
+
+	type scenario struct {
+		name  string
+		input []byte
+		error string
+	}
+
+	scenarios := []scenario{
+		{name: "plate before IAmCamera", input: plate, error: "plate reading before IAmCamera"},
+		{name: "plate from a dispatcher", input: join(dispatcher, plate), error: "dispatchers don't send plate readings"},
+		{name: "IAmCamera twice", input: join(camera, camera), error: "already registered as a camera"},
+		{name: "IAmDispatcher twice", input: join(dispatcher, dispatcher), error: "already registered as a dispatcher"},
+		{name: "dispatcher becoming a camera", input: join(dispatcher, camera), error: "already registered as a dispatcher"},
+		{name: "camera becoming a dispatcher", input: join(camera, dispatcher), error: "already registered as a camera"},
+		{name: "WantHeartbeat twice", input: join(heartbeat, heartbeat), error: "more than 1 heartbeat request"},
+		{name: "empty plate", input: join(camera, codec.Plate{Timestamp: 45}.Bytes()), error: "empty plate"},
+		{name: "unknown message type", input: []byte{0x99}, error: "unknown message type: 0x99"},
+		{name: "ticket from a client", input: codec.Ticket{Plate: "UN1X"}.Bytes(), error: "message type 0x21 is only sent by the server"},
+		{name: "heartbeat from a client", input: codec.Heartbeat{}.Bytes(), error: "message type 0x41 is only sent by the server"},
+		{name: "truncated plate", input: join(camera, plate[:len(plate)-2]), error: "truncated message"},
+		{name: "truncated IAmCamera", input: camera[:3], error: "truncated message"},
+		{name: "truncated IAmDispatcher", input: dispatcher[:3], error: "truncated message"},
+		{name: "truncated WantHeartbeat", input: heartbeat[:2], error: "truncated message"},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			sd := SpeedDaemon()
+			msgs := runSession(sd, s.input)
+			if len(msgs) != 1 {
+				t.Fatalf("expected a single error, got: %v", msgs)
+			}
+			if msgs[0] != (codec.Error{Message: s.error}) {
+				t.Fatalf("wrong reply. expected: %q, got: %v", s.error, msgs[0])
+			}
+			if len(sd.cameraFlashes) != 0 {
+				t.Fatalf("rejected session recorded readings: %v", sd.cameraFlashes)
+			}
+		})
+	}
+}
+
+func TestAcceptedSequences(t *testing.T) {
+
+	type scenario struct {
+		name  string
+		input []byte
+	}
+
+	scenarios := []scenario{
+		{name: "camera with readings", input: join(
+			codec.WantHeartbeat{Interval: 0}.Bytes(),
+			codec.IAmCamera{Road: 123, Mile: 8, Limit: 60}.Bytes(),
+			codec.Plate{Plate: "UN1X", Timestamp: 45}.Bytes(),
+		)},
+		{name: "dispatcher for no roads", input: codec.IAmDispatcher{Roads: []uint16{}}.Bytes()},
+		{name: "nothing sent", input: []byte{}},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			if msgs := runSession(SpeedDaemon(), s.input); len(msgs) != 0 {
+				t.Fatalf("unexpected replies: %v", msgs)
+			}
+		})
+	}
+}
+
+func TestSessionRoles(t *testing.T) {
+
+	type scenario struct {
+		name     string
+		messages []codec.Message
+		role     role
+		rejected int // index of the rejected message, -1 if all are accepted
+	}
+
+	camera := codec.IAmCamera{Road: 1, Mile: 2, Limit: 60}
+	dispatcher := codec.IAmDispatcher{Roads: []uint16{1}}
+	plate := codec.Plate{Plate: "UN1X", Timestamp: 1}
+
+	scenarios := []scenario{
+		{name: "no messages", role: roleNone, rejected: -1},
+		{name: "camera", messages: []codec.Message{camera, plate, plate}, role: roleCamera, rejected: -1},
+		{name: "dispatcher", messages: []codec.Message{dispatcher}, role: roleDispatcher, rejected: -1},
+		{name: "heartbeat before a role", messages: []codec.Message{codec.WantHeartbeat{}, camera}, role: roleCamera, rejected: -1},
+		{name: "plate first", messages: []codec.Message{plate, camera}, role: roleNone, rejected: 0},
+		{name: "camera then dispatcher", messages: []codec.Message{camera, dispatcher}, role: roleCamera, rejected: 1},
+		{name: "dispatcher then plate", messages: []codec.Message{dispatcher, plate}, role: roleDispatcher, rejected: 1},
+		{name: "server message", messages: []codec.Message{codec.Error{Message: "x"}}, role: roleNone, rejected: 0},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			sess := newSession(SpeedDaemon(), io.Discard, func(uint32) {})
+			defer sess.close(nil)
+
+			rejected := -1
+			for i, m := range s.messages {
+				if err := sess.handle(m); err != nil {
+					var perr protocolError
+					if !errors.As(err, &perr) {
+						t.Fatalf("not a protocol error: %v", err)
+					}
+					rejected = i
+					break
+				}
+			}
+
+			if rejected != s.rejected {
+				t.Fatalf("wrong rejected message. expected: %d, got: %d", s.rejected, rejected)
+			}
+			if sess.role != s.role {
+				t.Fatalf("wrong role. expected: %v, got: %v", s.role, sess.role)
+			}
+		})
+	}
+}
+
+func TestSessionStartsHeartbeat(t *testing.T) {
+
+	var intervals []uint32
+	sess := newSession(SpeedDaemon(), io.Discard, func(interval uint32) {
+		intervals = append(intervals, interval)
+	})
+
+	if err := sess.handle(codec.WantHeartbeat{Interval: 25}); err != nil {
+		t.Fatal(err)
+	}
+	if len(intervals) != 1 || intervals[0] != 25 {
+		t.Fatalf("heartbeat not started with the requested interval: %v", intervals)
+	}
+
+	// an interval of zero is a valid request for no heartbeats
+	sess = newSession(SpeedDaemon(), io.Discard, func(interval uint32) {
+		t.Fatalf("heartbeat started for interval %d", interval)
+	})
+	if err := sess.handle(codec.WantHeartbeat{Interval: 0}); err != nil {
+		t.Fatal(err)
+	}
+}
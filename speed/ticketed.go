@@ -0,0 +1,47 @@
+package main
+
+// ticketedDays records, for every plate, the days on which the car already
+// got a ticket, whatever the road. A ticket spanning several days counts for
+// each of them, so at most one ticket is issued per car per day.
+type ticketedDays map[string]map[uint16]struct{}
+
+// ticketDays returns the first and the last day covered by t.
+func ticketDays(t Ticket) (uint16, uint16) {
+	first, last := dayFromTimestamp(t.Timestamp1), dayFromTimestamp(t.Timestamp2)
+	if last < first {
+		first, last = last, first
+	}
+	return first, last
+}
+
+// Ticketed reports whether the car of t was already ticketed on any of the
+// days covered by t.
+func (d ticketedDays) Ticketed(t Ticket) bool {
+	days, ok := d[t.Plate]
+	if !ok {
+		return false
+	}
+
+	first, last := ticketDays(t)
+	for day := int(first); day <= int(last); day++ {
+		if _, ok := days[uint16(day)]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Add marks every day covered by t as ticketed for its plate.
+func (d ticketedDays) Add(t Ticket) {
+	days, ok := d[t.Plate]
+	if !ok {
+		days = make(map[uint16]struct{})
+		d[t.Plate] = days
+	}
+
+	first, last := ticketDays(t)
+	for day := int(first); day <= int(last); day++ {
+		days[uint16(day)] = struct{}{}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import "testing"
+
+func TestTicketedDays(t *testing.T) {
+
+	const day = 86400
+
+	type scenario struct {
+		name     string
+		previous []Ticket
+		ticket   Ticket
+		ticketed bool
+	}
+
+	scenarios := []scenario{
+		{
+			name:   "first ticket",
+			ticket: Ticket{Plate: "UN1X", Road: 1, Timestamp1: 10, Timestamp2: 100},
+		},
+		{
+			name:     "same day same road",
+			previous: []Ticket{{Plate: "UN1X", Road: 1, Timestamp1: 10, Timestamp2: 100}},
+			ticket:   Ticket{Plate: "UN1X", Road: 1, Timestamp1: 200, Timestamp2: 300},
+			ticketed: true,
+		},
+		{
+			name:     "same day other road",
+			previous: []Ticket{{Plate: "UN1X", Road: 1, Timestamp1: 10, Timestamp2: 100}},
+			ticket:   Ticket{Plate: "UN1X", Road: 2, Timestamp1: 200, Timestamp2: 300},
+			ticketed: true,
+		},
+		{
+			name:     "same day other plate",
+			previous: []Ticket{{Plate: "UN1X", Road: 1, Timestamp1: 10, Timestamp2: 100}},
+			ticket:   Ticket{Plate: "RE05BKG", Road: 1, Timestamp1: 200, Timestamp2: 300},
+		},
+		{
+			name:     "next day",
+			previous: []Ticket{{Plate: "UN1X", Road: 1, Timestamp1: 10, Timestamp2: 100}},
+			ticket:   Ticket{Plate: "UN1X", Road: 1, Timestamp1: day + 10, Timestamp2: day + 100},
+		},
+		{
+			name:     "multi-day ticket covers its last day",
+			previous: []Ticket{{Plate: "UN1X", Road: 1, Timestamp1: day - 10, Timestamp2: day + 10}},
+			ticket:   Ticket{Plate: "UN1X", Road: 2, Timestamp1: day + 100, Timestamp2: day + 200},
+			ticketed: true,
+		},
+		{
+			name:     "multi-day ticket covers the days in between",
+			previous: []Ticket{{Plate: "UN1X", Road: 1, Timestamp1: 10, Timestamp2: 3*day + 10}},
+			ticket:   Ticket{Plate: "UN1X", Road: 1, Timestamp1: 2*day + 10, Timestamp2: 2*day + 20},
+			ticketed: true,
+		},
+		{
+			name:     "multi-day ticket overlapping a ticketed day",
+			previous: []Ticket{{Plate: "UN1X", Road: 1, Timestamp1: 2*day + 10, Timestamp2: 2*day + 20}},
+			ticket:   Ticket{Plate: "UN1X", Road: 1, Timestamp1: day + 10, Timestamp2: 2*day + 5},
+			ticketed: true,
+		},
+		{
+			name:     "multi-day ticket next to a ticketed day",
+			previous: []Ticket{{Plate: "UN1X", Road: 1, Timestamp1: 10, Timestamp2: 20}},
+			ticket:   Ticket{Plate: "UN1X", Road: 1, Timestamp1: day + 10, Timestamp2: 2*day + 5},
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			s := s
+			t.Parallel()
+			d := make(ticketedDays)
+			for _, p := range s.previous {
+				d.Add(p)
+			}
+			if got := d.Ticketed(s.ticket); got != s.ticketed {
+				t.Fatalf("wrong ticketed status. expected: %v, got: %v", s.ticketed, got)
+			}
+		})
+	}
+}
+
+func TestOneTicketPerDayAcrossRoads(t *testing.T) {
+
+	sd := SpeedDaemon()
+
+	sd.Flash(PlateReading{Plate: "UN1X", Timestamp: 0, Camera: Camera{Road: 1, Mile: 8, Limit: 60}})
+	sd.Flash(PlateReading{Plate: "UN1X", Timestamp: 45, Camera: Camera{Road: 1, Mile: 9, Limit: 60}})
+	sd.Flash(PlateReading{Plate: "UN1X", Timestamp: 1000, Camera: Camera{Road: 2, Mile: 8, Limit: 60}})
+	sd.Flash(PlateReading{Plate: "UN1X", Timestamp: 1045, Camera: Camera{Road: 2, Mile: 9, Limit: 60}})
+
+	if _, err := sd.TicketForRoads([]uint16{1}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if ticket, err := sd.TicketForRoads([]uint16{2}, 0); err == nil {
+		t.Fatalf("second ticket on the same day: %v", ticket)
+	}
+}
@@ -0,0 +1,332 @@
+// Package ticketlog keeps an audit trail of the tickets issued by the speed
+// daemon in JSON-lines or CSV files, and reads such files back.
+package ticketlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mehix/protohackers/speed/codec"
+	"golang.org/x/exp/slices"
+)
+
+type Format string
+
+const (
+	JSON Format = "json" // one JSON document per line
+	CSV  Format = "csv"  // a header line, then one ticket per line
+)
+
+// ParseFormat accepts the name of a format.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case JSON, CSV:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown ticket log format %q, use %q or %q", s, JSON, CSV)
+	}
+}
+
+// Record is a ticket when it was issued, without Dispatcher and Delivered,
+// or when a dispatcher received it.
+type Record struct {
+	Plate      string    `json:"plate"`
+	Road       uint16    `json:"road"`
+	Limit      uint16    `json:"limit"`
+	Mile1      uint16    `json:"mile1"`
+	Timestamp1 uint32    `json:"timestamp1"`
+	Mile2      uint16    `json:"mile2"`
+	Timestamp2 uint32    `json:"timestamp2"`
+	Speed      uint16    `json:"speed"`      // hundredths of mph
+	Dispatcher string    `json:"dispatcher"` // address of the dispatcher that received it, empty until then
+	Issued     time.Time `json:"issued"`
+	Delivered  time.Time `json:"delivered"`
+}
+
+// NewRecord describes ticket t on a road with the given limit.
+func NewRecord(t codec.Ticket, limit uint16) Record {
+	return Record{
+		Plate:      t.Plate,
+		Road:       t.Road,
+		Limit:      limit,
+		Mile1:      t.Mile1,
+		Timestamp1: t.Timestamp1,
+		Mile2:      t.Mile2,
+		Timestamp2: t.Timestamp2,
+		Speed:      t.Speed,
+	}
+}
+
+// Ticket returns the ticket the record describes.
+func (r Record) Ticket() codec.Ticket {
+	return codec.Ticket{
+		Plate:      r.Plate,
+		Road:       r.Road,
+		Mile1:      r.Mile1,
+		Timestamp1: r.Timestamp1,
+		Mile2:      r.Mile2,
+		Timestamp2: r.Timestamp2,
+		Speed:      r.Speed,
+	}
+}
+
+var header = []string{"plate", "road", "limit", "mile1", "timestamp1", "mile2", "timestamp2", "speed", "dispatcher", "issued", "delivered"}
+
+func (r Record) fields() []string {
+	u := func(v uint32) string { return strconv.FormatUint(uint64(v), 10) }
+	return []string{
+		r.Plate,
+		u(uint32(r.Road)),
+		u(uint32(r.Limit)),
+		u(uint32(r.Mile1)),
+		u(r.Timestamp1),
+		u(uint32(r.Mile2)),
+		u(r.Timestamp2),
+		u(uint32(r.Speed)),
+		r.Dispatcher,
+		r.Issued.Format(time.RFC3339Nano),
+		r.Delivered.Format(time.RFC3339Nano),
+	}
+}
+
+func csvLine(fields []string) []byte {
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.Write(fields)
+	cw.Flush()
+	return buf.Bytes()
+}
+
+func parseFields(fields []string) (Record, error) {
+	if len(fields) != len(header) {
+		return Record{}, fmt.Errorf("expected %d fields, got %d", len(header), len(fields))
+	}
+
+	var r Record
+	var err error
+	u := func(s string, bits int) uint64 {
+		if err != nil {
+			return 0
+		}
+		var v uint64
+		v, err = strconv.ParseUint(s, 10, bits)
+		return v
+	}
+	t := func(s string) time.Time {
+		if err != nil {
+			return time.Time{}
+		}
+		var v time.Time
+		v, err = time.Parse(time.RFC3339Nano, s)
+		return v
+	}
+
+	r.Plate = fields[0]
+	r.Road = uint16(u(fields[1], 16))
+	r.Limit = uint16(u(fields[2], 16))
+	r.Mile1 = uint16(u(fields[3], 16))
+	r.Timestamp1 = uint32(u(fields[4], 32))
+	r.Mile2 = uint16(u(fields[5], 16))
+	r.Timestamp2 = uint32(u(fields[6], 32))
+	r.Speed = uint16(u(fields[7], 16))
+	r.Dispatcher = fields[8]
+	r.Issued = t(fields[9])
+	r.Delivered = t(fields[10])
+
+	return r, err
+}
+
+// Writer appends records to a file. Once the file grows past MaxSize it is
+// rotated: file becomes file.1, file.1 becomes file.2 and so on, keeping at
+// most Keep old files.
+type Writer struct {
+	path    string
+	format  Format
+	maxSize int64
+	keep    int
+
+	f    *os.File
+	size int64
+	m    sync.Mutex
+}
+
+// Open appends to the file at path, creating it if needed. A maxSize of 0
+// never rotates.
+func Open(path string, format Format, maxSize int64, keep int) (*Writer, error) {
+	w := &Writer{path: path, format: format, maxSize: maxSize, keep: keep}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	w.f = f
+	w.size = fi.Size()
+
+	if w.format == CSV && w.size == 0 {
+		return w.append(csvLine(header))
+	}
+	return nil
+}
+
+func (w *Writer) append(line []byte) error {
+	n, err := w.f.Write(line)
+	w.size += int64(n)
+	return err
+}
+
+// Write appends r, rotating the file first if r would not fit.
+func (w *Writer) Write(r Record) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if w.f == nil {
+		return os.ErrClosed
+	}
+
+	var line []byte
+	switch w.format {
+	case CSV:
+		line = csvLine(r.fields())
+	default:
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		line = append(data, '\n')
+	}
+
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(line)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	return w.append(line)
+}
+
+func (w *Writer) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	w.f = nil
+
+	if w.keep > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", w.path, w.keep))
+		for i := w.keep - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+		}
+		if err := os.Rename(w.path, w.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(w.path); err != nil {
+		return err
+	}
+
+	return w.open()
+}
+
+// Close flushes the file to disk and closes it.
+func (w *Writer) Close() error {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if w.f == nil {
+		return nil
+	}
+
+	err := w.f.Sync()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.f = nil
+	return err
+}
+
+// Read returns the records of a file written by a Writer. The format is
+// recognised from the content.
+func Read(r io.Reader) ([]Record, error) {
+	rdr := bufio.NewReader(r)
+
+	for {
+		b, err := rdr.Peek(1)
+		if err == io.EOF {
+			return []Record{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if b[0] == '{' {
+			return readJSON(rdr)
+		}
+		if b[0] != '\n' && b[0] != '\r' && b[0] != ' ' {
+			return readCSV(rdr)
+		}
+		rdr.ReadByte()
+	}
+}
+
+func readJSON(r io.Reader) ([]Record, error) {
+	records := make([]Record, 0)
+
+	dec := json.NewDecoder(r)
+	for {
+		var rec Record
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, fmt.Errorf("record %d: %w", len(records)+1, err)
+		}
+		records = append(records, rec)
+	}
+}
+
+func readCSV(r io.Reader) ([]Record, error) {
+	records := make([]Record, 0)
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	line := 0
+	for {
+		fields, err := cr.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		line++
+
+		if line == 1 && slices.Equal(fields, header) {
+			continue
+		}
+
+		rec, err := parseFields(fields)
+		if err != nil {
+			return records, fmt.Errorf("line %d: %w", line, err)
+		}
+		records = append(records, rec)
+	}
+}
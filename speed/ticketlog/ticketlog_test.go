@@ -0,0 +1,158 @@
+package ticketlog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func record(i int) Record {
+	issued := time.Date(2024, 5, 1, 10, 0, i, 0, time.UTC)
+	return Record{
+		Plate:      fmt.Sprintf("UN%dX", i),
+		Road:       123,
+		Limit:      60,
+		Mile1:      8,
+		Timestamp1: 0,
+		Mile2:      9,
+		Timestamp2: 45,
+		Speed:      8000,
+		Dispatcher: "127.0.0.1:4000",
+		Issued:     issued,
+		Delivered:  issued.Add(time.Second),
+	}
+}
+
+func readFile(t *testing.T, path string) []Record {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	records, err := Read(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestRoundTrip(t *testing.T) {
+
+	for _, format := range []Format{JSON, CSV} {
+		t.Run(string(format), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tickets")
+			expect := []Record{record(1), record(2), record(3)}
+
+			// written in two sessions to check that reopening appends
+			for _, part := range [][]Record{expect[:2], expect[2:]} {
+				w, err := Open(path, format, 0, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, r := range part {
+					if err := w.Write(r); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := w.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := readFile(t, path); !reflect.DeepEqual(got, expect) {
+				t.Fatalf("wrong records.\nexpected: %v\ngot:      %v", expect, got)
+			}
+		})
+	}
+}
+
+func TestCSVHeaderOnce(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "tickets.csv")
+	for i := 0; i < 2; i++ {
+		w, err := Open(path, CSV, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(record(i))
+		w.Close()
+	}
+
+	data, _ := os.ReadFile(path)
+	if n := strings.Count(string(data), "plate,road"); n != 1 {
+		t.Fatalf("expected one header, got %d:\n%s", n, data)
+	}
+}
+
+func TestRotation(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "tickets")
+	line := int64(len(mustJSONLine(t, record(0))))
+
+	// room for two records per file, keeping two old files
+	w, err := Open(path, JSON, 2*line, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		if err := w.Write(record(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	expect := map[string][]Record{
+		path:        {record(6)},
+		path + ".1": {record(4), record(5)},
+		path + ".2": {record(2), record(3)},
+	}
+	for p, records := range expect {
+		if got := readFile(t, p); !reflect.DeepEqual(got, records) {
+			t.Fatalf("%s: wrong records.\nexpected: %v\ngot:      %v", p, records, got)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("more old files kept than asked for: %v", err)
+	}
+}
+
+func mustJSONLine(t *testing.T, r Record) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "line")
+	w, err := Open(path, JSON, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(r)
+	w.Close()
+
+	data, _ := os.ReadFile(path)
+	return string(data)
+}
+
+func TestReadRejectsDamagedCSV(t *testing.T) {
+
+	_, err := Read(strings.NewReader(strings.Join(header, ",") + "\nUN1X,not a road,60,8,0,9,45,8000,,,\n"))
+	if err == nil {
+		t.Fatal("damaged line accepted")
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+
+	if f, err := ParseFormat("csv"); err != nil || f != CSV {
+		t.Fatalf("csv: %v %v", f, err)
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Fatal("unknown format accepted")
+	}
+}
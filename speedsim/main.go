@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/mehix/protohackers/logging"
+	"github.com/mehix/protohackers/server"
+	"github.com/mehix/protohackers/speed/codec"
+)
+
+// maxProblems limits how many verification problems are printed.
+const maxProblems = 20
+
+func main() {
+	var cfg config
+	flag.IntVar(&cfg.Roads, "roads", 3, "number of roads")
+	flag.IntVar(&cfg.Cameras, "cameras", 4, "cameras on each road")
+	var spacing, limit uint
+	flag.UintVar(&spacing, "spacing", 10, "miles between two cameras")
+	flag.UintVar(&limit, "limit", 60, "speed limit of every road, in mph")
+	flag.IntVar(&cfg.Cars, "cars", 100, "number of cars")
+	flag.Float64Var(&cfg.MinSpeed, "min-speed", 40, "slowest car, in mph")
+	flag.Float64Var(&cfg.MaxSpeed, "max-speed", 90, "fastest car, in mph")
+	flag.IntVar(&cfg.Dispatchers, "dispatchers", 2, "number of dispatchers")
+	flag.StringVar(&cfg.Prefix, "prefix", "SIM", "start of every plate")
+	flag.Int64Var(&cfg.Seed, "seed", time.Now().UnixNano(), "seed for the cars' roads and speeds")
+	timeout := flag.Duration("timeout", 30*time.Second, "time to wait for the tickets")
+	settle := flag.Duration("settle", time.Second, "time to wait for unexpected tickets after the expected ones arrived")
+	check := flag.Bool("check", true, "verify the tickets; disable to only generate load")
+	replay := flag.String("replay", "", "ticket export of the speed daemon to replay instead of simulated cars")
+	logConfig := logging.Flags(flag.CommandLine)
+	flag.Parse()
+	logConfig.Install()
+
+	if flag.NArg() < 1 {
+		fmt.Println("Usage: speedsim [flags] <speed server addr>")
+		os.Exit(1)
+	}
+	cfg.Spacing = uint16(spacing)
+	cfg.Limit = uint16(limit)
+
+	var p plan
+	var err error
+	if *replay != "" {
+		p, err = loadReplay(*replay, cfg.Dispatchers)
+		if err != nil {
+			fatal("loading replay", err)
+		}
+		fmt.Printf("Replay %s: ", *replay)
+	} else {
+		p, err = makePlan(cfg)
+		if err != nil {
+			fatal("planning the simulation", err)
+		}
+		fmt.Printf("Seed %d: ", cfg.Seed)
+	}
+
+	fmt.Printf("%d cameras, %d dispatchers, %d readings, %d tickets expected\n",
+		len(p.Cameras), len(p.Dispatchers), p.Readings, len(p.Expected))
+
+	ctx, stop := server.SignalContext()
+	defer stop()
+
+	res, err := run(ctx, flag.Arg(0), p, *timeout, *settle)
+	if err != nil {
+		fatal("simulation failed", err)
+	}
+
+	fmt.Printf("Sent %d readings in %v (%.0f/s), received %d tickets\n",
+		p.Readings, res.SendTime, float64(p.Readings)/res.SendTime.Seconds(), len(res.Tickets))
+
+	if *check {
+		problems := verify(p, res.Tickets)
+		for i, pr := range problems {
+			if i == maxProblems {
+				fmt.Printf("... and %d more\n", len(problems)-maxProblems)
+				break
+			}
+			fmt.Println(pr)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("All tickets as expected")
+	}
+}
+
+// fatal logs msg with err and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+type result struct {
+	Tickets  []codec.Ticket
+	SendTime time.Duration
+}
+
+// run connects the dispatchers, replays every camera's readings on a
+// connection of its own and collects the tickets until the expected number
+// arrived and settle passed, or timeout passed.
+func run(ctx context.Context, addr string, p plan, timeout, settle time.Duration) (result, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var res result
+	tickets := make(chan codec.Ticket)
+
+	for _, d := range p.Dispatchers {
+		conn, err := dial(addr, d)
+		if err != nil {
+			return res, err
+		}
+		defer conn.Close()
+
+		go receiveTickets(ctx, conn, tickets)
+	}
+
+	start := time.Now()
+	errs := make(chan error, len(p.Cameras))
+	for _, c := range p.Cameras {
+		go func(c camera) {
+			errs <- sendReadings(addr, c)
+		}(c)
+	}
+	for range p.Cameras {
+		if err := <-errs; err != nil {
+			return res, err
+		}
+	}
+	res.SendTime = time.Since(start)
+
+	var settled <-chan time.Time
+	for {
+		if settled == nil && len(res.Tickets) >= len(p.Expected) {
+			settled = time.After(settle)
+		}
+
+		select {
+		case t := <-tickets:
+			res.Tickets = append(res.Tickets, t)
+		case <-settled:
+			return res, nil
+		case <-ctx.Done():
+			return res, nil
+		}
+	}
+}
+
+func dial(addr string, m codec.Message) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := codec.Encode(conn, m); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func sendReadings(addr string, c camera) error {
+	conn, err := dial(addr, c.IAmCamera)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	for _, p := range c.Plates {
+		if err := codec.Encode(w, p); err != nil {
+			return err
+		}
+	}
+
+	return w.Flush()
+}
+
+func receiveTickets(ctx context.Context, conn net.Conn, tickets chan<- codec.Ticket) {
+	rdr := bufio.NewReader(conn)
+	for {
+		m, err := codec.Decode(rdr)
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				slog.Warn("dispatcher connection failed", "err", err)
+			}
+			return
+		}
+
+		switch m := m.(type) {
+		case codec.Ticket:
+			select {
+			case tickets <- m:
+			case <-ctx.Done():
+				return
+			}
+		case codec.Error:
+			slog.Warn("dispatcher got an error", "error", m.Message)
+			return
+		}
+	}
+}
+
+// verify compares the tickets with the plan: every expected ticket issued
+// exactly once, on its road, and no other ticket issued.
+func verify(p plan, tickets []codec.Ticket) []string {
+	problems := make([]string, 0)
+
+	seen := make(map[ticketKey]int)
+	for _, t := range tickets {
+		key := keyOf(t)
+		seen[key]++
+		road, ok := p.Expected[key]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("unexpected ticket: %+v", t))
+		case road != t.Road:
+			problems = append(problems, fmt.Sprintf("ticket on road %d, expected road %d: %+v", t.Road, road, t))
+		}
+	}
+
+	for key, n := range seen {
+		if n > 1 {
+			problems = append(problems, fmt.Sprintf("%s ticketed %d times on day %d", key.Plate, n, key.Day))
+		}
+	}
+
+	for key := range p.Expected {
+		if seen[key] == 0 {
+			problems = append(problems, fmt.Sprintf("missing ticket for %s on day %d", key.Plate, key.Day))
+		}
+	}
+
+	sort.Strings(problems)
+	return problems
+}
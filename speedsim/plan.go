@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+
+	"github.com/mehix/protohackers/speed/codec"
+)
+
+type config struct {
+	Roads       int     // number of roads
+	Cameras     int     // cameras on each road
+	Spacing     uint16  // miles between two cameras on a road
+	Limit       uint16  // speed limit of every road, in mph
+	Cars        int     // cars to drive through the cameras
+	MinSpeed    float64 // slowest car, in mph
+	MaxSpeed    float64 // fastest car, in mph
+	Dispatchers int     // dispatchers, each responsible for a share of the roads
+	Prefix      string  // start of every plate, to tell runs apart
+	Seed        int64
+}
+
+// camera is one simulated camera and the plates it reports, in time order.
+type camera struct {
+	codec.IAmCamera
+	Plates []codec.Plate
+}
+
+// ticketKey identifies a ticket: the server issues at most one per car and
+// day.
+type ticketKey struct {
+	Plate string
+	Day   uint32
+}
+
+func keyOf(t codec.Ticket) ticketKey {
+	return ticketKey{Plate: t.Plate, Day: t.Timestamp1 / 86400}
+}
+
+// plan is everything a simulation sends and the tickets it must produce.
+type plan struct {
+	Cameras     []camera
+	Dispatchers []codec.IAmDispatcher
+	// Expected maps every ticket that must be issued to its road.
+	Expected map[ticketKey]uint16
+	Readings int
+}
+
+// maxCars keeps the timestamps of the last day, travel time included, within
+// the uint32 range.
+const maxCars = 49000
+
+// makePlan drives every car along one road, each on a day of its own so the
+// one-ticket-per-day rule never hides a ticket. A car must be ticketed when
+// the average speed between any two consecutive cameras, computed like the
+// server does, reaches the limit plus the 0.5 mph tolerance.
+func makePlan(cfg config) (plan, error) {
+	if cfg.Roads < 1 || cfg.Cameras < 2 || cfg.Dispatchers < 1 {
+		return plan{}, fmt.Errorf("need at least 1 road, 2 cameras per road and 1 dispatcher")
+	}
+	if cfg.Cars > maxCars {
+		return plan{}, fmt.Errorf("at most %d cars, one per day", maxCars)
+	}
+	if cfg.MinSpeed <= 0 || cfg.MaxSpeed < cfg.MinSpeed {
+		return plan{}, fmt.Errorf("invalid speed range: %v-%v", cfg.MinSpeed, cfg.MaxSpeed)
+	}
+	if hours := float64(cfg.Cameras-1) * float64(cfg.Spacing) / cfg.MinSpeed; hours > 22 {
+		return plan{}, fmt.Errorf("the slowest car needs %.0f hours, it must pass every camera within a day", hours)
+	}
+
+	rnd := rand.New(rand.NewSource(cfg.Seed))
+
+	p := plan{Expected: make(map[ticketKey]uint16)}
+
+	for r := 0; r < cfg.Roads; r++ {
+		for c := 0; c < cfg.Cameras; c++ {
+			p.Cameras = append(p.Cameras, camera{IAmCamera: codec.IAmCamera{
+				Road:  uint16(r + 1),
+				Mile:  uint16(c) * cfg.Spacing,
+				Limit: cfg.Limit,
+			}})
+		}
+	}
+
+	for d := 0; d < cfg.Dispatchers; d++ {
+		p.Dispatchers = append(p.Dispatchers, codec.IAmDispatcher{Roads: []uint16{}})
+	}
+	for r := 0; r < cfg.Roads; r++ {
+		d := &p.Dispatchers[r%cfg.Dispatchers]
+		d.Roads = append(d.Roads, uint16(r+1))
+	}
+
+	for i := 0; i < cfg.Cars; i++ {
+		plate := fmt.Sprintf("%s%d", cfg.Prefix, i)
+		road := rnd.Intn(cfg.Roads)
+		speed := cfg.MinSpeed + rnd.Float64()*(cfg.MaxSpeed-cfg.MinSpeed)
+		start := uint32(i)*86400 + uint32(rnd.Intn(3600))
+
+		timestamps := make([]uint32, cfg.Cameras)
+		for c := 0; c < cfg.Cameras; c++ {
+			cam := &p.Cameras[road*cfg.Cameras+c]
+			timestamps[c] = start + uint32(math.Round(float64(cam.Mile)/speed*3600))
+			cam.Plates = append(cam.Plates, codec.Plate{Plate: plate, Timestamp: timestamps[c]})
+			p.Readings++
+		}
+
+		for c := 1; c < cfg.Cameras; c++ {
+			if speeding(cfg.Spacing, timestamps[c]-timestamps[c-1], cfg.Limit) {
+				p.Expected[ticketKey{Plate: plate, Day: uint32(i)}] = uint16(road + 1)
+				break
+			}
+		}
+	}
+
+	for _, cam := range p.Cameras {
+		sort.Slice(cam.Plates, func(i, j int) bool {
+			return cam.Plates[i].Timestamp < cam.Plates[j].Timestamp
+		})
+	}
+
+	return p, nil
+}
+
+// speeding applies the server's rule: the speed in hundredths of mph,
+// rounded down, at or above the limit plus 50.
+func speeding(miles uint16, seconds uint32, limit uint16) bool {
+	if seconds == 0 {
+		return false
+	}
+	return uint64(miles)*360000/uint64(seconds) >= uint64(limit)*100+50
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mehix/protohackers/speed/codec"
+	"github.com/mehix/protohackers/speed/ticketlog"
+)
+
+func TestSpeeding(t *testing.T) {
+
+	type scenario struct {
+		name    string
+		miles   uint16
+		seconds uint32
+		expect  bool
+	}
+
+	scenarios := []scenario{
+		{name: "at the limit", miles: 60, seconds: 3600, expect: false},
+		{name: "just below the tolerance", miles: 121, seconds: 7201, expect: false},
+		{name: "at the tolerance", miles: 121, seconds: 7200, expect: true},
+		{name: "same time", miles: 1, seconds: 0, expect: false},
+	}
+
+	for _, s := range scenarios {
+		if got := speeding(s.miles, s.seconds, 60); got != s.expect {
+			t.Errorf("%s: expected: %v, got: %v", s.name, s.expect, got)
+		}
+	}
+}
+
+func TestMakePlan(t *testing.T) {
+
+	cfg := config{Roads: 3, Cameras: 4, Spacing: 10, Limit: 60, Cars: 200, MinSpeed: 40, MaxSpeed: 90, Dispatchers: 2, Prefix: "T", Seed: 1}
+
+	p, err := makePlan(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(p.Cameras) != 12 || p.Readings != 800 {
+		t.Fatalf("wrong plan size: %d cameras, %d readings", len(p.Cameras), p.Readings)
+	}
+	if len(p.Expected) == 0 || len(p.Expected) == cfg.Cars {
+		t.Fatalf("expected some, not all, cars to be ticketed: %d of %d", len(p.Expected), cfg.Cars)
+	}
+
+	covered := make(map[uint16]bool)
+	for _, d := range p.Dispatchers {
+		for _, r := range d.Roads {
+			covered[r] = true
+		}
+	}
+	if len(covered) != cfg.Roads {
+		t.Fatalf("not every road has a dispatcher: %v", p.Dispatchers)
+	}
+
+	again, _ := makePlan(cfg)
+	if len(again.Expected) != len(p.Expected) {
+		t.Fatalf("same seed gave different plans")
+	}
+
+	if _, err := makePlan(config{Roads: 1, Cameras: 1, Dispatchers: 1, MinSpeed: 1, MaxSpeed: 1}); err == nil {
+		t.Fatal("a single camera per road should be rejected")
+	}
+}
+
+func TestVerify(t *testing.T) {
+
+	p := plan{Expected: map[ticketKey]uint16{{Plate: "A"}: 1, {Plate: "B"}: 2, {Plate: "B", Day: 1}: 2}}
+
+	expect := []codec.Ticket{{Plate: "A", Road: 1}, {Plate: "B", Road: 2}, {Plate: "B", Road: 2, Timestamp1: 86400}}
+	if problems := verify(p, expect); len(problems) != 0 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+
+	tickets := []codec.Ticket{{Plate: "A", Road: 1}, {Plate: "A", Road: 1}, {Plate: "B", Road: 2}, {Plate: "C", Road: 1}}
+	if problems := verify(p, tickets); len(problems) != 3 {
+		t.Fatalf("expected a duplicate, an unexpected and a missing ticket, got: %v", problems)
+	}
+}
+
+func TestReplayPlan(t *testing.T) {
+
+	records := []ticketlog.Record{
+		{Plate: "UN1X", Road: 1, Limit: 60, Mile1: 8, Timestamp1: 0, Mile2: 9, Timestamp2: 45},
+		{Plate: "UN1X", Road: 1, Limit: 60, Mile1: 9, Timestamp1: 86400, Mile2: 10, Timestamp2: 86445},
+		{Plate: "RE05BKG", Road: 2, Limit: 50, Mile1: 8, Timestamp1: 0, Mile2: 9, Timestamp2: 45},
+		// the same reading as the first ticket's, sent once
+		{Plate: "UN1X", Road: 1, Limit: 60, Mile1: 9, Timestamp1: 45, Mile2: 10, Timestamp2: 90},
+		// exported again once delivered, replayed once
+		{Plate: "RE05BKG", Road: 2, Limit: 50, Mile1: 8, Timestamp1: 0, Mile2: 9, Timestamp2: 45, Dispatcher: "10.0.0.1:5000"},
+	}
+
+	p, err := replayPlan(records, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(p.Cameras) != 5 {
+		t.Fatalf("expected a camera on 5 positions, got: %v", p.Cameras)
+	}
+	if p.Readings != 7 {
+		t.Fatalf("expected 7 readings, got: %d", p.Readings)
+	}
+	for _, c := range p.Cameras {
+		if c.Road == 2 && c.Limit != 50 {
+			t.Fatalf("camera without the limit of its road: %v", c.IAmCamera)
+		}
+	}
+
+	expect := map[ticketKey]uint16{{Plate: "UN1X"}: 1, {Plate: "UN1X", Day: 1}: 1, {Plate: "RE05BKG"}: 2}
+	if !reflect.DeepEqual(p.Expected, expect) {
+		t.Fatalf("wrong tickets expected. expected: %v, got: %v", expect, p.Expected)
+	}
+	if len(p.Dispatchers[0].Roads) != 1 || len(p.Dispatchers[1].Roads) != 1 {
+		t.Fatalf("roads not shared between the dispatchers: %v", p.Dispatchers)
+	}
+}
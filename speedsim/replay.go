@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/mehix/protohackers/speed/codec"
+	"github.com/mehix/protohackers/speed/ticketlog"
+)
+
+// loadReplay reads a ticket export of the speed daemon and plans to send
+// the two readings behind every ticket, so a fresh daemon issues the same
+// tickets again.
+func loadReplay(path string, dispatchers int) (plan, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return plan{}, err
+	}
+	defer f.Close()
+
+	records, err := ticketlog.Read(f)
+	if err != nil {
+		return plan{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return replayPlan(records, dispatchers)
+}
+
+// replayPlan puts a camera wherever a ticket was measured. Readings shared
+// by several tickets are sent once, so a ticket exported both when issued and
+// when delivered is replayed once. Tickets of the same car on the same road
+// are replayed together, so the daemon may pair their readings differently
+// than it did the first time.
+func replayPlan(records []ticketlog.Record, dispatchers int) (plan, error) {
+	if dispatchers < 1 {
+		return plan{}, fmt.Errorf("need at least 1 dispatcher")
+	}
+
+	type position struct{ Road, Mile uint16 }
+	type reading struct {
+		position
+		codec.Plate
+	}
+
+	p := plan{Expected: make(map[ticketKey]uint16)}
+	cameras := make(map[position]int) // position => index in p.Cameras
+	sent := make(map[reading]bool)
+	roads := make(map[uint16]bool)
+
+	add := func(r ticketlog.Record, mile uint16, timestamp uint32) {
+		pos := position{Road: r.Road, Mile: mile}
+		idx, ok := cameras[pos]
+		if !ok {
+			idx = len(p.Cameras)
+			cameras[pos] = idx
+			p.Cameras = append(p.Cameras, camera{IAmCamera: codec.IAmCamera{Road: r.Road, Mile: mile, Limit: r.Limit}})
+		}
+
+		plate := codec.Plate{Plate: r.Plate, Timestamp: timestamp}
+		if sent[reading{pos, plate}] {
+			return
+		}
+		sent[reading{pos, plate}] = true
+		p.Cameras[idx].Plates = append(p.Cameras[idx].Plates, plate)
+		p.Readings++
+	}
+
+	for _, r := range records {
+		add(r, r.Mile1, r.Timestamp1)
+		add(r, r.Mile2, r.Timestamp2)
+		p.Expected[keyOf(r.Ticket())] = r.Road
+		roads[r.Road] = true
+	}
+
+	for _, cam := range p.Cameras {
+		sort.Slice(cam.Plates, func(i, j int) bool {
+			return cam.Plates[i].Timestamp < cam.Plates[j].Timestamp
+		})
+	}
+
+	ids := make([]uint16, 0, len(roads))
+	for road := range roads {
+		ids = append(ids, road)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for d := 0; d < dispatchers; d++ {
+		p.Dispatchers = append(p.Dispatchers, codec.IAmDispatcher{Roads: []uint16{}})
+	}
+	for i, road := range ids {
+		d := &p.Dispatchers[i%dispatchers]
+		d.Roads = append(d.Roads, road)
+	}
+
+	return p, nil
+}
@@ -2,11 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"sync"
+	"time"
+
+	"github.com/mehix/protohackers/logging"
+	"github.com/mehix/protohackers/metrics"
+	"github.com/mehix/protohackers/server"
 )
 
 type db struct {
@@ -33,20 +40,58 @@ func (d *db) Get(key string) (string, bool) {
 	return v, ok
 }
 
+func (d *db) Len() int {
+	d.m.RLock()
+	defer d.m.RUnlock()
+	return len(d.r)
+}
+
 var data = NewDb()
 
+var (
+	metricsAddr = flag.String("metrics", "", "address of the Prometheus metrics endpoint (empty disables it)")
+	logConfig   = logging.Flags(flag.CommandLine)
+)
+
+// stats count what the database serves.
+type stats struct {
+	requests *metrics.CounterVec // by kind: insert, retrieve or version
+	in, out  *metrics.Counter
+}
+
+func newStats(r *metrics.Registry) stats {
+	r.GaugeFunc("udpdb_keys", "Keys stored.", func() int64 { return int64(data.Len()) })
+	return stats{
+		requests: r.CounterVec("udpdb_requests_total", "Requests received, by kind.", "kind"),
+		in:       r.Counter("bytes_received_total", "Bytes read from clients."),
+		out:      r.Counter("bytes_sent_total", "Bytes written to clients."),
+	}
+}
+
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: udpdb <addr>")
+	flag.Parse()
+	logConfig.Install()
+	if flag.NArg() < 1 {
+		fmt.Println("Usage: udpdb [flags] <addr>")
+		os.Exit(1)
+	}
+
+	ctx, stop := server.SignalContext()
+	defer stop()
+
+	reg, err := metrics.Listen(ctx, *metricsAddr)
+	if err != nil {
+		slog.Error("starting metrics endpoint", "err", err)
 		os.Exit(1)
 	}
 
-	if err := startDb(os.Args[1]); err != nil {
-		log.Fatal(err)
+	if err := startDb(ctx, flag.Arg(0), newStats(reg)); err != nil {
+		slog.Error("server stopped", "err", err)
+		os.Exit(1)
 	}
 }
 
-func startDb(addr string) error {
+func startDb(ctx context.Context, addr string, st stats) error {
 
 	l, err := net.ListenPacket("udp", addr)
 	if err != nil {
@@ -54,22 +99,41 @@ func startDb(addr string) error {
 	}
 	defer l.Close()
 
-	fmt.Printf("Listen UDP on %s\n", l.LocalAddr())
+	slog.Info("listening", "addr", l.LocalAddr().String())
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// unblock ReadFrom
+			l.SetReadDeadline(time.Now())
+		case <-stopped:
+		}
+	}()
 
 	buf := make([]byte, 1000)
 	for {
 		n, remoteAddr, err := l.ReadFrom(buf)
 		if err != nil {
-			log.Println("connection", err)
+			if ctx.Err() != nil {
+				slog.Info("shutting down")
+				return nil
+			}
 			return err
 		}
 
-		fmt.Printf("Read %d bytes\n", n)
+		if slog.Default().Enabled(ctx, slog.LevelDebug) {
+			slog.LogAttrs(ctx, slog.LevelDebug, "request", slog.String("remote", remoteAddr.String()), slog.Int("size", n))
+		}
+		st.in.Add(uint64(n))
+		st.requests.With(requestKind(buf[:n])).Inc()
 		resp, _ := handleRequest(buf[:n])
 		if resp != nil {
 			if _, err := l.WriteTo(resp, remoteAddr); err != nil {
 				return err
 			}
+			st.out.Add(uint64(len(resp)))
 		}
 	}
 }
@@ -86,6 +150,17 @@ func handleRequest(req []byte) ([]byte, error) {
 	return handleRetrieve(req)
 }
 
+// requestKind tells apart the requests handleRequest serves.
+func requestKind(req []byte) string {
+	if bytes.IndexByte(req, '=') > 0 {
+		return "insert"
+	}
+	if string(req) == "version" {
+		return "version"
+	}
+	return "retrieve"
+}
+
 func handleInsert(key, val []byte) ([]byte, error) {
 	if string(key) == "version" {
 		return nil, fmt.Errorf("cannot store version")